@@ -5,6 +5,7 @@ import (
 	"../utils"
 	"bytes"
 	"code.google.com/p/goauth2/oauth"
+	"context"
 	"crypto/md5"
 	"encoding/gob"
 	"encoding/hex"
@@ -19,16 +20,29 @@ import (
 	"net/http"
 	neturl "net/url"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	apiURL      = "https://pcs.baidu.com/rest/2.0/pcs"
+	uploadURL   = "https://c.pcs.baidu.com/rest/2.0/pcs"
+	downloadURL = "https://d.pcs.baidu.com/rest/2.0/pcs"
+)
+
+const ERROR_FILE_NOT_EXISTS = 31066
+
 type Baidu struct {
 	dir              string
 	client           *http.Client
 	token            *oauth.Token
 	keys             map[string]bool
+	keysLock         sync.RWMutex
 	keyCacheFilePath string
-	newKey           chan string
+	newKey           chan string // to mark the key cache dirty
+	saveLock         sync.Mutex
 }
 
 func New(dir string, token *oauth.Token, keyCacheFilePath string) (*Baidu, error) {
@@ -78,33 +92,52 @@ func (self *Baidu) start() {
 		select {
 		case <-ticker.C:
 			if dirty {
-				if self.keyCacheFilePath == "" {
-					continue
-				}
-				f, err := os.Create(self.keyCacheFilePath + ".new")
-				if err != nil {
-					log.Fatalf("cannot open key cache file: %v", err)
-				}
-				t0 := time.Now()
-				err = gob.NewEncoder(f).Encode(self.keys)
+				err := self.saveKeys()
 				if err != nil {
-					log.Fatalf("cannot write key cache file: %v", err)
+					log.Fatal(err)
 				}
-				err = os.Rename(self.keyCacheFilePath+".new", self.keyCacheFilePath)
-				if err != nil {
-					log.Fatalf("cannot write key cache file: %v", err)
-				}
-				fmt.Printf("=> %d keys saved to cache file / %v\n", len(self.keys),
-					time.Now().Sub(t0))
 				dirty = false
 			}
-		case key := <-self.newKey:
-			self.keys[key] = true
+		case <-self.newKey:
 			dirty = true
 		}
 	}
 }
 
+func (self *Baidu) addKey(key string) {
+	self.keysLock.Lock()
+	self.keys[key] = true
+	self.keysLock.Unlock()
+	self.newKey <- key
+}
+
+func (self *Baidu) saveKeys() error {
+	if self.keyCacheFilePath == "" {
+		return nil
+	}
+	self.saveLock.Lock()
+	defer self.saveLock.Unlock()
+	f, err := os.Create(self.keyCacheFilePath + ".new")
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot open key cache file: %v", err))
+	}
+	t0 := time.Now()
+	self.keysLock.RLock()
+	err = gob.NewEncoder(f).Encode(self.keys)
+	n := len(self.keys)
+	self.keysLock.RUnlock()
+	f.Close()
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot write key cache file: %v", err))
+	}
+	err = os.Rename(self.keyCacheFilePath+".new", self.keyCacheFilePath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot write key cache file: %v", err))
+	}
+	fmt.Printf("=> %d keys saved to cache file / %v\n", n, time.Now().Sub(t0))
+	return nil
+}
+
 func NewBaiduWithStringToken(dir, tokenStr string, keyCacheFilePath string) (*Baidu, error) {
 	var token oauth.Token
 	tokenBytes, err := hex.DecodeString(tokenStr)
@@ -135,11 +168,33 @@ func (self *Baidu) GetQuota() (quota int, used int, err error) {
 }
 
 func (self *Baidu) get(api, method string, params map[string]string) (*jsonq.JsonQuery, error) {
-	url := fmt.Sprintf("https://pcs.baidu.com/rest/2.0/pcs/%s?method=%s&access_token=%s", api, method, self.token.AccessToken)
+	return self.getContext(context.Background(), api, method, params)
+}
+
+func (self *Baidu) getContext(ctx context.Context, api, method string, params map[string]string) (*jsonq.JsonQuery, error) {
+	url := fmt.Sprintf("%s/%s?method=%s&access_token=%s", apiURL, api, method, self.token.AccessToken)
 	for key, value := range params {
 		url += fmt.Sprintf("&%s=%s", key, value)
 	}
-	resp, err := self.client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return self.query(req, api, method)
+}
+
+func (self *Baidu) postContext(ctx context.Context, api, method string, form neturl.Values) (*jsonq.JsonQuery, error) {
+	url := fmt.Sprintf("%s/%s?method=%s&access_token=%s", apiURL, api, method, self.token.AccessToken)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return self.query(req, api, method)
+}
+
+func (self *Baidu) query(req *http.Request, api, method string) (*jsonq.JsonQuery, error) {
+	resp, err := self.client.Do(req)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("%s %s %v", method, api, err))
 	}
@@ -154,22 +209,25 @@ func (self *Baidu) get(api, method string, params map[string]string) (*jsonq.Jso
 	return jsonq.NewQuery(data), nil
 }
 
-func (self *Baidu) upload(path string, data []byte, length int) error {
-	url := fmt.Sprintf("https://c.pcs.baidu.com/rest/2.0/pcs/file?method=upload&access_token=%s&ondup=overwrite", self.token.AccessToken)
+func (self *Baidu) upload(ctx context.Context, path string, data io.Reader, length int) error {
+	url := fmt.Sprintf("%s/file?method=upload&access_token=%s&ondup=overwrite", uploadURL, self.token.AccessToken)
 	url += "&path=" + neturl.QueryEscape(fmt.Sprintf("/apps/%s/%s", self.dir, path))
 
-	buf := new(bytes.Buffer)
-	form := multipart.NewWriter(buf)
-	field, _ := form.CreateFormFile("file", "file")
-	field.Write(data)
-	form.Close()
-	resp, err := self.client.Post(url, form.FormDataContentType(), buf)
+	hasher := md5.New()
+	body, contentType, size := utils.MultipartBody("file", io.TeeReader(data, hasher), length)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := self.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	buf.Reset()
+	buf := new(bytes.Buffer)
 	_, err = io.Copy(buf, resp.Body)
 	if err != nil {
 		return errors.New("response body read error")
@@ -183,14 +241,16 @@ func (self *Baidu) upload(path string, data []byte, length int) error {
 	if resp.StatusCode != http.StatusOK { // error
 		errCode, _ := q.Int("error_code")
 		errMsg, _ := q.String("error_msg")
-		return errors.New(fmt.Sprintf("server error %d %s", errCode, errMsg))
+		err = errors.New(fmt.Sprintf("server error %d %s", errCode, errMsg))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return hashbin.Permanent(err)
+		}
+		return err
 	} else { // ok
 		retSize, _ := q.Int("size")
 		if retSize != length {
 			return errors.New("upload size wrong")
 		}
-		hasher := md5.New()
-		hasher.Write(data)
 		md5, _ := q.String("md5")
 		if fmt.Sprintf("%x", hasher.Sum(nil)) != md5 {
 			return errors.New("md5 not match")
@@ -200,28 +260,63 @@ func (self *Baidu) upload(path string, data []byte, length int) error {
 }
 
 func (self *Baidu) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
-	buf := new(bytes.Buffer)
-	return buf, func(err error) error {
-		if err != nil {
-			return err
-		}
-		err = self.upload(fmt.Sprintf("%s/%d-%s", hash[:2], length, hash), buf.Bytes(), length)
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *Baidu) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	key := fmt.Sprintf("%d-%s", length, hash)
+	writer, cb := hashbin.NewPipeWriter(length, func(data io.Reader) error {
+		return self.upload(ctx, fmt.Sprintf("%s/%s", hash[:2], key), data, length)
+	})
+	return writer, func(err error) error {
+		err = cb(err)
 		if err != nil {
 			return err
 		}
-		self.newKey <- fmt.Sprintf("%d-%s", length, hash)
+		self.addKey(key)
 		return nil
 	}, nil
 }
 
+// save the key cache
+func (self *Baidu) Flush() error {
+	return self.saveKeys()
+}
+
 func (self *Baidu) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *Baidu) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.download(ctx, length, hash, "")
+}
+
+func (self *Baidu) NewRangeReader(length int, hash string, offset, size int) (io.Reader, hashbin.Callback, error) {
+	if size == 0 {
+		return bytes.NewReader(nil), nil, nil
+	}
+	return self.download(context.Background(), length, hash, fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+}
+
+func (self *Baidu) download(ctx context.Context, length int, hash string, byteRange string) (io.Reader, hashbin.Callback, error) {
 	path := neturl.QueryEscape(fmt.Sprintf("/apps/%s/%s/%d-%s", self.dir, hash[:2], length, hash))
-	url := fmt.Sprintf("https://d.pcs.baidu.com/rest/2.0/pcs/file?method=download&access_token=%s&path=%s", self.token.AccessToken, path)
-	resp, err := self.client.Get(url)
+	url := fmt.Sprintf("%s/file?method=download&access_token=%s&path=%s", downloadURL, self.token.AccessToken, path)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := self.client.Do(req)
 	if err != nil {
 		return nil, nil, errors.New(fmt.Sprintf("get error: %s", url))
 	}
-	if resp.StatusCode != http.StatusOK {
+	if byteRange != "" && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, errors.New("range not supported by server")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		buf := new(bytes.Buffer)
 		_, err = io.Copy(buf, resp.Body)
 		if err != nil {
@@ -247,16 +342,184 @@ func (self *Baidu) NewReader(length int, hash string) (io.Reader, hashbin.Callba
 }
 
 func (self *Baidu) Exists(length int, hash string) (bool, error) {
+	return self.ExistsContext(context.Background(), length, hash)
+}
+
+func (self *Baidu) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
 	key := fmt.Sprintf("%d-%s", length, hash)
-	if _, ok := self.keys[key]; ok {
+	self.keysLock.RLock()
+	_, ok := self.keys[key]
+	self.keysLock.RUnlock()
+	if ok {
 		return true, nil
 	}
-	//TODO query server
-	return false, nil
+	q, err := self.getContext(ctx, "file", "meta", map[string]string{
+		"path": neturl.QueryEscape(fmt.Sprintf("/apps/%s/%s/%s", self.dir, hash[:2], key)),
+	})
+	if err != nil {
+		return false, err
+	}
+	if errCode, err := q.Int("error_code"); err == nil {
+		if errCode == ERROR_FILE_NOT_EXISTS {
+			return false, nil
+		}
+		errMsg, _ := q.String("error_msg")
+		return false, errors.New(fmt.Sprintf("meta error %d %s", errCode, errMsg))
+	}
+	list, err := q.ArrayOfObjects("list")
+	if err != nil || len(list) == 0 {
+		return false, nil
+	}
+	self.addKey(key)
+	return true, nil
+}
+
+const (
+	// paths per batch meta request
+	META_BATCH_SIZE = 100
+)
+
+// keys not in the key cache are checked by batch meta requests
+func (self *Baidu) ExistsBatch(ctx context.Context, keys []string) (map[string]bool, error) {
+	present := make(map[string]bool)
+	unknown := make([]string, 0)
+	self.keysLock.RLock()
+	for _, key := range keys {
+		if self.keys[key] {
+			present[key] = true
+		} else {
+			unknown = append(unknown, key)
+		}
+	}
+	self.keysLock.RUnlock()
+	singles := make([]string, 0)
+	for start := 0; start < len(unknown); start += META_BATCH_SIZE {
+		end := start + META_BATCH_SIZE
+		if end > len(unknown) {
+			end = len(unknown)
+		}
+		err := self.metaBatch(ctx, unknown[start:end], present, &singles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	found, err := hashbin.ExistsConcurrently(ctx, singles, hashbin.EXISTS_WORKERS, self.ExistsContext)
+	if err != nil {
+		return nil, err
+	}
+	for key := range found {
+		present[key] = true
+	}
+	return present, nil
+}
+
+// a batch fails as a whole if any file is missing, then its keys are added to singles
+// instead of splitting it, since missing files are rarely alone in a batch
+func (self *Baidu) metaBatch(ctx context.Context, keys []string, present map[string]bool, singles *[]string) error {
+	list := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		_, hash, err := hashbin.ParseKey(key)
+		if err != nil {
+			return err
+		}
+		list = append(list, map[string]string{
+			"path": fmt.Sprintf("/apps/%s/%s/%s", self.dir, hash[:2], key),
+		})
+	}
+	param, err := json.Marshal(map[string]interface{}{"list": list})
+	if err != nil {
+		return err
+	}
+	q, err := self.postContext(ctx, "file", "meta", neturl.Values{"param": {string(param)}})
+	if err != nil {
+		return err
+	}
+	if errCode, err := q.Int("error_code"); err == nil {
+		if errCode != ERROR_FILE_NOT_EXISTS {
+			errMsg, _ := q.String("error_msg")
+			return errors.New(fmt.Sprintf("meta error %d %s", errCode, errMsg))
+		}
+		*singles = append(*singles, keys...)
+		return nil
+	}
+	entries, err := q.ArrayOfObjects("list")
+	if err != nil {
+		return errors.New("bad meta response")
+	}
+	for _, entry := range entries {
+		p, ok := entry["path"].(string)
+		if !ok {
+			continue
+		}
+		key := path.Base(p)
+		present[key] = true
+		self.addKey(key)
+	}
+	return nil
+}
+
+// replace the key cache with a full listing of the server
+func (self *Baidu) RebuildKeys() error {
+	keys := make(map[string]bool)
+	chars := "0123456789abcdef"
+	for _, a := range chars {
+		for _, b := range chars {
+			dir := fmt.Sprintf("%c%c", a, b)
+			n, err := self.listDir(dir, func(name string, mtime time.Time) {
+				keys[name] = true
+			})
+			if err != nil {
+				return errors.New(fmt.Sprintf("list %s: %v", dir, err))
+			}
+			fmt.Printf("listed %s, %d files\n", dir, n)
+		}
+	}
+	self.keysLock.Lock()
+	self.keys = keys
+	self.keysLock.Unlock()
+	return self.saveKeys()
+}
+
+const LIST_PAGE_SIZE = 1000
+
+func (self *Baidu) listDir(dir string, fn func(name string, mtime time.Time)) (int, error) {
+	n := 0
+	for start := 0; ; start += LIST_PAGE_SIZE {
+		q, err := self.get("file", "list", map[string]string{
+			"path":  neturl.QueryEscape(fmt.Sprintf("/apps/%s/%s", self.dir, dir)),
+			"limit": fmt.Sprintf("%d-%d", start, start+LIST_PAGE_SIZE),
+		})
+		if err != nil {
+			return n, err
+		}
+		if errCode, err := q.Int("error_code"); err == nil {
+			errMsg, _ := q.String("error_msg")
+			return n, errors.New(fmt.Sprintf("list error %d %s", errCode, errMsg))
+		}
+		list, err := q.ArrayOfObjects("list")
+		if err != nil {
+			return n, errors.New("bad list response")
+		}
+		for _, entry := range list {
+			if isDir, ok := entry["isdir"].(float64); ok && isDir != 0 {
+				continue
+			}
+			p, ok := entry["path"].(string)
+			if !ok {
+				continue
+			}
+			mtime, _ := entry["mtime"].(float64)
+			fn(path.Base(p), time.Unix(int64(mtime), 0))
+			n++
+		}
+		if len(list) < LIST_PAGE_SIZE {
+			return n, nil
+		}
+	}
 }
 
 func (self *Baidu) Mkdir(path string) error {
-	url := fmt.Sprintf("https://pcs.baidu.com/rest/2.0/pcs/file?method=mkdir&access_token=%s", self.token.AccessToken)
+	url := fmt.Sprintf("%s/file?method=mkdir&access_token=%s", apiURL, self.token.AccessToken)
 	url += "&path=" + neturl.QueryEscape(fmt.Sprintf("/apps/%s/%s", self.dir, path))
 
 	buf := new(bytes.Buffer)
@@ -286,3 +549,66 @@ func (self *Baidu) Mkdir(path string) error {
 	}
 	return nil
 }
+
+func (self *Baidu) List() ([]hashbin.Entry, error) {
+	entries := make([]hashbin.Entry, 0)
+	chars := "0123456789abcdef"
+	for _, a := range chars {
+		for _, b := range chars {
+			dir := fmt.Sprintf("%c%c", a, b)
+			_, err := self.listDir(dir, func(name string, mtime time.Time) {
+				length, hash, err := hashbin.ParseKey(name)
+				if err != nil {
+					return
+				}
+				entries = append(entries, hashbin.Entry{
+					Length: length,
+					Hash:   hash,
+					Time:   mtime,
+				})
+			})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("list %s: %v", dir, err))
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (self *Baidu) Delete(length int, hash string) error {
+	key := fmt.Sprintf("%d-%s", length, hash)
+	url := fmt.Sprintf("%s/file?method=delete&access_token=%s", apiURL, self.token.AccessToken)
+	url += "&path=" + neturl.QueryEscape(fmt.Sprintf("/apps/%s/%s/%s", self.dir, hash[:2], key))
+
+	buf := new(bytes.Buffer)
+	form := multipart.NewWriter(buf)
+	form.Close()
+	resp, err := self.client.Post(url, form.FormDataContentType(), buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf.Reset()
+	_, err = io.Copy(buf, resp.Body)
+	if err != nil {
+		return errors.New("response body read error")
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody := make(map[string]interface{})
+		err = json.NewDecoder(buf).Decode(&respBody)
+		if err != nil {
+			return errors.New("return json decode error")
+		}
+		q := jsonq.NewQuery(respBody)
+		errCode, _ := q.Int("error_code")
+		errMsg, _ := q.String("error_msg")
+		return errors.New(fmt.Sprintf("server error %d %s", errCode, errMsg))
+	}
+
+	self.keysLock.Lock()
+	delete(self.keys, key)
+	self.keysLock.Unlock()
+	self.newKey <- key
+	return nil
+}
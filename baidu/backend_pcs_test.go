@@ -0,0 +1,284 @@
+package baidu
+
+import (
+	"../compression"
+	"../hashbin"
+	"code.google.com/p/goauth2/oauth"
+	"context"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake PCS server
+type fakePCS struct {
+	sync.Mutex
+	files   map[string][]byte
+	mtimes  map[string]int64
+	metas   int
+	batches int
+}
+
+func (self *fakePCS) counts() (metas, batches int) {
+	self.Lock()
+	defer self.Unlock()
+	return self.metas, self.batches
+}
+
+func (self *fakePCS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+	query := req.URL.Query()
+	p := query.Get("path")
+	switch req.URL.Path + " " + query.Get("method") {
+	case "/quota info":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"quota": 1 << 30, "used": 0})
+	case "/file upload":
+		f, _, err := req.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, 31023, "param error")
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		self.files[p] = data
+		self.mtimes[p] = time.Now().Unix()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"path": p,
+			"size": len(data),
+			"md5":  fmt.Sprintf("%x", md5.Sum(data)),
+		})
+	case "/file download":
+		data, ok := self.files[p]
+		if !ok {
+			writeError(w, http.StatusNotFound, ERROR_FILE_NOT_EXISTS, "file does not exist")
+			return
+		}
+		var start, end int
+		if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 {
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Write(data)
+	case "/file meta":
+		if req.Method == "POST" {
+			self.batchMeta(w, req)
+			return
+		}
+		self.metas++
+		data, ok := self.files[p]
+		if !ok {
+			writeError(w, http.StatusNotFound, ERROR_FILE_NOT_EXISTS, "file does not exist")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{"path": p, "size": len(data), "isdir": 0},
+			},
+		})
+	case "/file list":
+		limit := strings.Split(query.Get("limit"), "-")
+		start, _ := strconv.Atoi(limit[0])
+		end, _ := strconv.Atoi(limit[1])
+		// pages of a stable order
+		names := make([]string, 0)
+		for name := range self.files {
+			if path.Dir(name) == p {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		list := make([]interface{}, 0)
+		for i, name := range names {
+			if i >= start && i < end {
+				list = append(list, map[string]interface{}{"path": name, "size": len(self.files[name]), "isdir": 0, "mtime": self.mtimes[name]})
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"list": list})
+	case "/file delete":
+		if _, ok := self.files[p]; !ok {
+			writeError(w, http.StatusNotFound, ERROR_FILE_NOT_EXISTS, "file does not exist")
+			return
+		}
+		delete(self.files, p)
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+	case "/file mkdir":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"path": p})
+	default:
+		writeError(w, http.StatusBadRequest, 3, "unsupported")
+	}
+}
+
+// fails as a whole if any file is missing
+func (self *fakePCS) batchMeta(w http.ResponseWriter, req *http.Request) {
+	self.batches++
+	var param struct {
+		List []struct {
+			Path string
+		}
+	}
+	err := json.Unmarshal([]byte(req.FormValue("param")), &param)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 31023, "param error")
+		return
+	}
+	list := make([]interface{}, 0)
+	for _, entry := range param.List {
+		data, ok := self.files[entry.Path]
+		if !ok {
+			writeError(w, http.StatusNotFound, ERROR_FILE_NOT_EXISTS, "file does not exist")
+			return
+		}
+		list = append(list, map[string]interface{}{"path": entry.Path, "size": len(data), "isdir": 0})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"list": list})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, msg string) {
+	writeJSON(w, status, map[string]interface{}{"error_code": code, "error_msg": msg})
+}
+
+func TestFakePCS(t *testing.T) {
+	fake := &fakePCS{
+		files:  make(map[string][]byte),
+		mtimes: make(map[string]int64),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	apiURL, uploadURL, downloadURL = server.URL, server.URL, server.URL
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyCacheFilePath := path.Join(dir, "baidu.keys")
+	baidu, err := New("test", &oauth.Token{AccessToken: "token"}, keyCacheFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(baidu)
+	hashbin.RunTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunRangeTest(bin, t)
+	hashbin.RunContextTest(bin, t)
+
+	// compressed objects are not of the chunk lengths
+	compressed, err := compression.New(baidu, compression.ZSTD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashbin.RunTest(hashbin.New(compressed), t)
+	hashbin.RunListTest(hashbin.New(compressed), t)
+
+	// exists queries the server without the key cache
+	data := []byte("foobar")
+	hash := fmt.Sprintf("%x", sha512.Sum512(data))
+	exists, err := baidu.Exists(len(data), hash)
+	if err != nil || exists {
+		t.Fatalf("exists before save: %v %v", exists, err)
+	}
+	fake.Lock()
+	fake.files[fmt.Sprintf("/apps/test/%s/%d-%s", hash[:2], len(data), hash)] = data
+	metas := fake.metas
+	fake.Unlock()
+	exists, err = baidu.Exists(len(data), hash)
+	if err != nil || !exists {
+		t.Fatalf("exists on server: %v %v", exists, err)
+	}
+	exists, err = baidu.Exists(len(data), hash)
+	if n, _ := fake.counts(); err != nil || !exists || n != metas+1 {
+		t.Fatal("positive answer not cached")
+	}
+
+	// batch exists without the key cache
+	fresh, err := New("test", &oauth.Token{AccessToken: "token"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	expected := make(map[string]bool)
+	fake.Lock()
+	for i := 0; i < 2*META_BATCH_SIZE+10; i++ {
+		data := []byte(fmt.Sprintf("batch %d", i))
+		hash := fmt.Sprintf("%x", sha512.Sum512(data))
+		key := fmt.Sprintf("%d-%s", len(data), hash)
+		keys = append(keys, key)
+		if i%50 == 7 {
+			continue
+		}
+		fake.files[fmt.Sprintf("/apps/test/%s/%s", hash[:2], key)] = data
+		expected[key] = true
+	}
+	fake.Unlock()
+	metas, batches := fake.counts()
+	present, err := fresh.ExistsBatch(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(present) != len(expected) {
+		t.Fatalf("%d keys present, expected %d", len(present), len(expected))
+	}
+	for key := range expected {
+		if !present[key] {
+			t.Fatalf("%s not present", key)
+		}
+	}
+	// 3 batches, all failing, so each key costs a single request
+	if n, m := fake.counts(); n-metas != len(keys) || m-batches != 3 {
+		t.Fatalf("%d single and %d batch meta requests", n-metas, m-batches)
+	}
+
+	// all missing
+	missing := make([]string, 0)
+	for i := 0; i < 2*META_BATCH_SIZE+10; i++ {
+		data := []byte(fmt.Sprintf("missing %d", i))
+		missing = append(missing, fmt.Sprintf("%d-%x", len(data), sha512.Sum512(data)))
+	}
+	metas, batches = fake.counts()
+	present, err = fresh.ExistsBatch(context.Background(), missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(present) > 0 {
+		t.Fatalf("%d missing keys present", len(present))
+	}
+	// one request per batch, and a single request per key
+	if n, m := fake.counts(); n-metas != len(missing) || m-batches != 3 {
+		t.Fatalf("%d single and %d batch meta requests", n-metas, m-batches)
+	}
+
+	// rebuild key cache
+	fake.Lock()
+	n := len(fake.files)
+	fake.Unlock()
+	err = baidu.RebuildKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(baidu.keys) != n {
+		t.Fatalf("rebuilt %d keys, expected %d", len(baidu.keys), n)
+	}
+	other, err := New("test", &oauth.Token{AccessToken: "token"}, keyCacheFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other.keys) != n {
+		t.Fatalf("key cache file has %d keys, expected %d", len(other.keys), n)
+	}
+}
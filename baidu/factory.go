@@ -0,0 +1,26 @@
+package baidu
+
+import (
+	"../hashbin"
+	"code.google.com/p/goauth2/oauth"
+	"path/filepath"
+)
+
+func init() {
+	hashbin.RegisterFactory("baidu", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		dir := spec.Param("dir", "")
+		if dir == "" {
+			err := env.Credential(spec, "dir", "baidu_dir", &dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var token oauth.Token
+		err := env.Credential(spec, "token", "baidu_token", &token)
+		if err != nil {
+			return nil, err
+		}
+		keyCacheFilePath := spec.Param("key_cache", filepath.Join(env.DataDir, env.Name+".keys"))
+		return New(dir, &token, keyCacheFilePath)
+	})
+}
@@ -8,7 +8,8 @@ import (
 	"log"
 )
 
-func Setup(register *register.Register) error {
+// the token and the dir are saved under the given register entries
+func Setup(register *register.Register, tokenKey, dirKey string) error {
 	var key, secret, dir string
 	fmt.Printf("enter app key:\n")
 	n, err := fmt.Scanf("%s\n", &key)
@@ -43,11 +44,11 @@ func Setup(register *register.Register) error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = register.Set("baidu_token", token)
+	err = register.Set(tokenKey, token)
 	if err != nil {
 		return err
 	}
-	err = register.Set("baidu_dir", dir)
+	err = register.Set(dirKey, dir)
 	if err != nil {
 		return err
 	}
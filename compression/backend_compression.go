@@ -0,0 +1,341 @@
+package compression
+
+import (
+	"../hashbin"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+)
+
+// codec header of stored objects
+const (
+	RAW = iota
+	GZIP
+	ZSTD
+)
+
+// compressed lengths are not known from the keys, so objects are stored under their
+// compressed length, and a record under a key derived from the hash holds that length.
+// a record is the compressed length, the length and the hash
+const RECORD_HEADER = 16
+
+// longest hash of a record, larger objects are not records
+const MAX_RECORD_HASH = 1024
+
+type Compression struct {
+	backend hashbin.Backend
+	codec   int
+	encoder *zstd.Encoder
+	// stored keys are not recoverable from backends storing objects under other keys
+	mapped bool
+}
+
+func New(backend hashbin.Backend, codec int) (*Compression, error) {
+	if codec != RAW && codec != GZIP && codec != ZSTD {
+		return nil, errors.New(fmt.Sprintf("unknown codec %d", codec))
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	probe := fmt.Sprintf("%x", sha512.Sum512([]byte("FileStore compression probe")))
+	length, hash := hashbin.MapKey(backend, len(probe), probe)
+	return &Compression{
+		backend: backend,
+		codec:   codec,
+		encoder: encoder,
+		mapped:  length != len(probe) || hash != probe,
+	}, nil
+}
+
+// refs are small and rewritten in place, they are stored as is
+func passthrough(length int) bool {
+	return length == hashbin.REF_LENGTH
+}
+
+func recordName(hash string) string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte("FileStore compression record "+hash)))
+}
+
+func recordKey(hash string) (int, string) {
+	return RECORD_HEADER + len(hash), recordName(hash)
+}
+
+func encodeRecord(storedLength, length int, hash string) []byte {
+	record := make([]byte, RECORD_HEADER, RECORD_HEADER+len(hash))
+	binary.BigEndian.PutUint64(record, uint64(storedLength))
+	binary.BigEndian.PutUint64(record[8:], uint64(length))
+	return append(record, hash...)
+}
+
+func decodeRecord(record []byte) (int, int, string, error) {
+	if len(record) < RECORD_HEADER {
+		return 0, 0, "", errors.New("invalid record")
+	}
+	return int(binary.BigEndian.Uint64(record)), int(binary.BigEndian.Uint64(record[8:])), string(record[RECORD_HEADER:]), nil
+}
+
+func save(ctx context.Context, backend hashbin.Backend, length int, hash string, data []byte) error {
+	writer, cb, err := hashbin.WithContext(backend).NewWriterContext(ctx, length, hash)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if cb != nil {
+		err = cb(err)
+	}
+	return err
+}
+
+func fetch(ctx context.Context, backend hashbin.Backend, length int, hash string) ([]byte, error) {
+	reader, cb, err := hashbin.WithContext(backend).NewReaderContext(ctx, length, hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(length)+1))
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, errors.New("stored data length not match")
+	}
+	return data, nil
+}
+
+// the stored length of an object from its record
+func (self *Compression) storedLength(ctx context.Context, length int, hash string) (int, error) {
+	recordLength, recordHash := recordKey(hash)
+	record, err := fetch(ctx, self.backend, recordLength, recordHash)
+	if err != nil {
+		return 0, err
+	}
+	storedLength, l, h, err := decodeRecord(record)
+	if err != nil {
+		return 0, err
+	}
+	if l != length || h != hash {
+		return 0, errors.New("record not match")
+	}
+	return storedLength, nil
+}
+
+func ParseCodec(name string) (int, error) {
+	switch name {
+	case "raw", "none":
+		return RAW, nil
+	case "gzip":
+		return GZIP, nil
+	case "zstd":
+		return ZSTD, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown codec %s", name))
+}
+
+func (self *Compression) compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(self.codec))
+	switch self.codec {
+	case GZIP:
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+	case ZSTD:
+		buf.Write(self.encoder.EncodeAll(data, nil))
+	}
+	// store uncompressible data raw
+	if self.codec == RAW || buf.Len() >= len(data)+1 {
+		buf.Reset()
+		buf.WriteByte(RAW)
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+func (self *Compression) decompress(data []byte, length int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("missing codec header")
+	}
+	var reader io.Reader
+	switch data[0] {
+	case RAW:
+		return data[1:], nil
+	case GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		reader = r
+	case ZSTD:
+		r, err := zstd.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		reader = r
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown codec %d", data[0]))
+	}
+	// do not inflate beyond the expected length
+	return ioutil.ReadAll(io.LimitReader(reader, int64(length)+1))
+}
+
+func (self *Compression) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *Compression) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	if passthrough(length) {
+		return hashbin.WithContext(self.backend).NewWriterContext(ctx, length, hash)
+	}
+	buf := new(bytes.Buffer)
+	return buf, func(err error) error {
+		if err != nil {
+			return err
+		}
+		data, err := self.compress(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		// the record is written last, so an existing record means an existing object
+		err = save(ctx, self.backend, len(data), hash, data)
+		if err != nil {
+			return err
+		}
+		recordLength, recordHash := recordKey(hash)
+		return save(ctx, self.backend, recordLength, recordHash, encodeRecord(len(data), length, hash))
+	}, nil
+}
+
+func (self *Compression) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *Compression) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	if passthrough(length) {
+		return hashbin.WithContext(self.backend).NewReaderContext(ctx, length, hash)
+	}
+	storedLength, err := self.storedLength(ctx, length, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := fetch(ctx, self.backend, storedLength, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = self.decompress(data, length)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("decompress error: %v", err))
+	}
+	return bytes.NewReader(data), nil, nil
+}
+
+// the key of an object, or of its record
+func (self *Compression) storedKey(length int, hash string) (int, string) {
+	if passthrough(length) {
+		return length, hash
+	}
+	return recordKey(hash)
+}
+
+func (self *Compression) Exists(length int, hash string) (bool, error) {
+	return self.backend.Exists(self.storedKey(length, hash))
+}
+
+func (self *Compression) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	storedLength, storedHash := self.storedKey(length, hash)
+	return hashbin.WithContext(self.backend).ExistsContext(ctx, storedLength, storedHash)
+}
+
+func (self *Compression) ExistsBatch(ctx context.Context, keys []string) (map[string]bool, error) {
+	stored := make([]string, 0, len(keys))
+	plain := make(map[string]string)
+	for _, key := range keys {
+		length, hash, err := hashbin.ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		storedLength, storedHash := self.storedKey(length, hash)
+		storedKey := fmt.Sprintf("%d-%s", storedLength, storedHash)
+		stored = append(stored, storedKey)
+		plain[storedKey] = key
+	}
+	present, err := hashbin.ExistsBatch(ctx, self.backend, stored)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for storedKey := range present {
+		ret[plain[storedKey]] = true
+	}
+	return ret, nil
+}
+
+// objects are kept by their records, see List
+func (self *Compression) MapKey(length int, hash string) (int, string) {
+	storedLength, storedHash := self.storedKey(length, hash)
+	return hashbin.MapKey(self.backend, storedLength, storedHash)
+}
+
+func (self *Compression) Flush() error {
+	return hashbin.Flush(self.backend)
+}
+
+// objects with records are listed by their records, objects without are listed as is
+func (self *Compression) List() ([]hashbin.Entry, error) {
+	if self.mapped {
+		return nil, hashbin.ErrNotSupported
+	}
+	entries, err := hashbin.List(self.backend)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.Hash] = true
+	}
+	ret := make([]hashbin.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !passthrough(entry.Length) && names[recordName(entry.Hash)] {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+// deleting a record deletes its object too
+func (self *Compression) Delete(length int, hash string) error {
+	if self.mapped || length <= RECORD_HEADER || length > RECORD_HEADER+MAX_RECORD_HASH {
+		return hashbin.Delete(self.backend, length, hash)
+	}
+	record, err := fetch(context.Background(), self.backend, length, hash)
+	if err != nil {
+		return err
+	}
+	err = hashbin.Delete(self.backend, length, hash)
+	if err != nil {
+		return err
+	}
+	storedLength, _, h, err := decodeRecord(record)
+	if err != nil || recordName(h) != hash {
+		return nil
+	}
+	return hashbin.Delete(self.backend, storedLength, h)
+}
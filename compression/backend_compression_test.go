@@ -0,0 +1,127 @@
+package compression
+
+import (
+	"../erasure"
+	"../hashbin"
+	"../pack"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressionBackend(t *testing.T) {
+	for _, codec := range []int{RAW, GZIP, ZSTD} {
+		mem := hashbin.NewMembin()
+		compression, err := New(mem, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin := hashbin.New(compression)
+		hashbin.RunTest(bin, t)
+		hashbin.RunRefTest(bin, t)
+		hashbin.RunListTest(bin, t)
+		hashbin.RunContextTest(bin, t)
+
+		// compressible
+		data := bytes.Repeat([]byte("foobar"), 1024*1024)
+		hash := fmt.Sprintf("%x", sha512.Sum512(data))
+		err = bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := storedBytes(t, compression, mem, len(data), hash)
+		if stored[0] != byte(codec) {
+			t.Fatalf("codec %d: stored with codec %d", codec, stored[0])
+		}
+		if codec != RAW && len(stored) >= len(data) {
+			t.Fatalf("codec %d: data not compressed", codec)
+		}
+		buf := new(bytes.Buffer)
+		err = bin.Fetch(len(data), hash, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatal("fetch data incorrect")
+		}
+
+		// uncompressible
+		data = make([]byte, 1024*1024)
+		rand.Read(data)
+		hash = fmt.Sprintf("%x", sha512.Sum512(data))
+		err = bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = storedBytes(t, compression, mem, len(data), hash)
+		if stored[0] != RAW || len(stored) != len(data)+1 {
+			t.Fatalf("codec %d: uncompressible data not stored raw", codec)
+		}
+	}
+}
+
+func storedBytes(t *testing.T, compression *Compression, mem *hashbin.Membin, length int, hash string) []byte {
+	storedLength, err := compression.storedLength(context.Background(), length, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := mem.NewReader(storedLength, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// stored objects are shorter or longer than the chunks, backends checking lengths must accept them
+func TestCompressionOver(t *testing.T) {
+	packed, err := pack.New(hashbin.NewMembin(), "test", "a", 1024*1024, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make([]hashbin.Backend, 5)
+	for i := range shards {
+		shards[i] = hashbin.NewMembin()
+	}
+	erasured, err := erasure.New(shards, 3, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []hashbin.Backend{packed, erasured} {
+		compression, err := New(backend, ZSTD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin := hashbin.New(compression)
+		hashbin.RunTest(bin, t)
+		hashbin.RunRefTest(bin, t)
+		hashbin.RunListTest(bin, t)
+		for _, data := range [][]byte{bytes.Repeat([]byte("foobar"), 1024*1024), make([]byte, 64*1024)} {
+			rand.Read(data[:1024])
+			hash := fmt.Sprintf("%x", sha512.Sum512(data))
+			err = bin.Save(len(data), hash, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = hashbin.Flush(backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := new(bytes.Buffer)
+			err = bin.Fetch(len(data), hash, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Fatal("fetch data incorrect")
+			}
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package compression
+
+import (
+	"../hashbin"
+)
+
+func init() {
+	hashbin.RegisterFactory("compression", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		backend, err := env.Open(spec.Param("backend", ""))
+		if err != nil {
+			return nil, err
+		}
+		codec, err := ParseCodec(spec.Param("codec", "zstd"))
+		if err != nil {
+			return nil, err
+		}
+		return New(backend, codec)
+	})
+}
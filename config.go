@@ -0,0 +1,171 @@
+package main
+
+import (
+	"./hashbin"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backends.json in the data dir, e.g.
+//
+//	{
+//	  "default": "secure",
+//	  "backends": {
+//	    "baidu": {"type": "baidu", "credentials": {"token": "baidu_token"}},
+//	    "nas": {"type": "local", "params": {"dir": "/mnt/nas/FileStore"}},
+//	    "secure": {"type": "crypt", "params": {"backend": "nas"}},
+//	    "office": {"type": "ratelimit", "params": {"backend": "baidu", "rate": "1m", "windows": "18:00-08:00=0"}}
+//	  }
+//	}
+type Config struct {
+	Default  string                   `json:"default"`
+	Backends map[string]*hashbin.Spec `json:"backends"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := &Config{
+		Default: "baidu",
+		Backends: map[string]*hashbin.Spec{
+			"baidu": &hashbin.Spec{Type: "baidu"},
+		},
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config = new(Config)
+	err = json.NewDecoder(f).Decode(config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decode config %s: %v", path, err))
+	}
+	if config.Default == "" && len(config.Backends) == 1 {
+		for name := range config.Backends {
+			config.Default = name
+		}
+	}
+	return config, nil
+}
+
+func (self *App) getConfig() (*Config, error) {
+	if self.config == nil {
+		config, err := loadConfig(filepath.Join(self.dataDir, "backends.json"))
+		if err != nil {
+			return nil, err
+		}
+		self.config = config
+	}
+	return self.config, nil
+}
+
+func (self *App) backendSpec(name string) (*hashbin.Spec, error) {
+	config, err := self.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	spec, ok := config.Backends[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no backend named %s", name))
+	}
+	return spec, nil
+}
+
+func (self *App) openBackend(name string) (hashbin.Backend, error) {
+	return self.openBackendFrom(name, make(map[string]bool))
+}
+
+func (self *App) openBackendFrom(name string, opening map[string]bool) (hashbin.Backend, error) {
+	if opening[name] {
+		return nil, errors.New(fmt.Sprintf("backend %s wraps itself", name))
+	}
+	opening[name] = true
+	defer delete(opening, name)
+	spec, err := self.backendSpec(name)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := hashbin.NewBackend(spec, &hashbin.Env{
+		Name:        name,
+		DataDir:     self.dataDir,
+		Credentials: self.register,
+		Open: func(inner string) (hashbin.Backend, error) {
+			return self.openBackendFrom(inner, opening)
+		},
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("open backend %s: %v", name, err))
+	}
+	return backend, nil
+}
+
+// names of the backends holding the data of name, found by following
+// the backend and backends params of wrappers
+func (self *App) storageBackends(name string) (map[string]bool, error) {
+	storage := make(map[string]bool)
+	err := self.collectStorage(name, storage, make(map[string]bool))
+	return storage, err
+}
+
+func (self *App) collectStorage(name string, storage, visiting map[string]bool) error {
+	if visiting[name] {
+		return errors.New(fmt.Sprintf("backend %s wraps itself", name))
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+	spec, err := self.backendSpec(name)
+	if err != nil {
+		return err
+	}
+	inner := make([]string, 0)
+	if backend := spec.Param("backend", ""); backend != "" {
+		inner = append(inner, backend)
+	}
+	if backends := spec.Param("backends", ""); backends != "" {
+		inner = append(inner, strings.Split(backends, ",")...)
+	}
+	if len(inner) == 0 {
+		storage[name] = true
+		return nil
+	}
+	for _, n := range inner {
+		err = self.collectStorage(strings.TrimSpace(n), storage, visiting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the backend named by --backend, or the default one
+func (self *App) backendName() (string, error) {
+	if self.selectedBackend != "" {
+		return self.selectedBackend, nil
+	}
+	config, err := self.getConfig()
+	if err != nil {
+		return "", err
+	}
+	if config.Default == "" {
+		return "", errors.New("no default backend configured")
+	}
+	return config.Default, nil
+}
+
+func (self *App) getBackend() (*hashbin.Bin, error) {
+	name, err := self.backendName()
+	if err != nil {
+		return nil, err
+	}
+	backend, err := self.openBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	return hashbin.New(backend), nil
+}
@@ -0,0 +1,229 @@
+package crypt
+
+import (
+	"../hashbin"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	KEY_LENGTH = 32
+	// bytes of the plaintext length kept inside the ciphertext
+	LENGTH_SIZE = 8
+	// smallest padded size, so small chunks share one bucket
+	MIN_PADDED_SIZE = 1024
+)
+
+type Crypt struct {
+	backend hashbin.Backend
+	aead    cipher.AEAD
+	nameKey []byte
+}
+
+func New(backend hashbin.Backend, key []byte) (*Crypt, error) {
+	if len(key) != KEY_LENGTH {
+		return nil, errors.New(fmt.Sprintf("invalid key length %d", len(key)))
+	}
+	block, err := aes.NewCipher(subKey(key, "data"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Crypt{
+		backend: backend,
+		aead:    aead,
+		nameKey: subKey(key, "name"),
+	}, nil
+}
+
+func subKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("FileStore " + purpose))
+	return h.Sum(nil)
+}
+
+// the stored object is named by a keyed hash and sized by a bucket,
+// so neither the plaintext hash nor the exact length is revealed
+func (self *Crypt) storedKey(length int, hash string) (int, string) {
+	h := hmac.New(sha512.New, self.nameKey)
+	fmt.Fprintf(h, "%d-%s", length, hash)
+	return paddedSize(length) + self.aead.NonceSize() + self.aead.Overhead(), hex.EncodeToString(h.Sum(nil))
+}
+
+// the size of the length header and the data, rounded up to a bucket.
+// buckets keep only the top bits of the size, wasting at most about 12%
+func paddedSize(length int) int {
+	size := length + LENGTH_SIZE
+	if size <= MIN_PADDED_SIZE {
+		return MIN_PADDED_SIZE
+	}
+	exp := 0
+	for n := size; n > 1; n >>= 1 {
+		exp++
+	}
+	bits := 0
+	for n := exp; n > 1; n >>= 1 {
+		bits++
+	}
+	mask := (1 << uint(exp-bits-1)) - 1
+	return (size + mask) &^ mask
+}
+
+// the length header, the data and zero padding
+func pad(data []byte) []byte {
+	padded := make([]byte, paddedSize(len(data)))
+	binary.BigEndian.PutUint64(padded, uint64(len(data)))
+	copy(padded[LENGTH_SIZE:], data)
+	return padded
+}
+
+func unpad(padded []byte, length int) ([]byte, error) {
+	if len(padded) < LENGTH_SIZE {
+		return nil, errors.New("padded data too short")
+	}
+	n := binary.BigEndian.Uint64(padded)
+	if n != uint64(length) || length > len(padded)-LENGTH_SIZE {
+		return nil, errors.New(fmt.Sprintf("bad padded length %d", n))
+	}
+	return padded[LENGTH_SIZE : LENGTH_SIZE+length], nil
+}
+
+func (self *Crypt) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *Crypt) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	buf := new(bytes.Buffer)
+	return buf, func(err error) error {
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, self.aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return err
+		}
+		data := self.aead.Seal(nonce, nonce, pad(buf.Bytes()), []byte(fmt.Sprintf("%d-%s", length, hash)))
+		storedLength, storedHash := self.storedKey(length, hash)
+		writer, cb, err := hashbin.WithContext(self.backend).NewWriterContext(ctx, storedLength, storedHash)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(data)
+		if cb != nil {
+			err = cb(err)
+		}
+		return err
+	}, nil
+}
+
+func (self *Crypt) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *Crypt) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	storedLength, storedHash := self.storedKey(length, hash)
+	reader, cb, err := hashbin.WithContext(self.backend).NewReaderContext(ctx, storedLength, storedHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	nonceSize := self.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, nil, errors.New("encrypted data too short")
+	}
+	padded, err := self.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(fmt.Sprintf("%d-%s", length, hash)))
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("decrypt error: %v", err))
+	}
+	plaintext, err := unpad(padded, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(plaintext), nil, nil
+}
+
+func (self *Crypt) Exists(length int, hash string) (bool, error) {
+	return self.backend.Exists(self.storedKey(length, hash))
+}
+
+func (self *Crypt) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	storedLength, storedHash := self.storedKey(length, hash)
+	return hashbin.WithContext(self.backend).ExistsContext(ctx, storedLength, storedHash)
+}
+
+func (self *Crypt) ExistsBatch(ctx context.Context, keys []string) (map[string]bool, error) {
+	stored := make([]string, 0, len(keys))
+	plain := make(map[string]string)
+	for _, key := range keys {
+		length, hash, err := hashbin.ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		storedLength, storedHash := self.storedKey(length, hash)
+		storedKey := fmt.Sprintf("%d-%s", storedLength, storedHash)
+		stored = append(stored, storedKey)
+		plain[storedKey] = key
+	}
+	present, err := hashbin.ExistsBatch(ctx, self.backend, stored)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for storedKey := range present {
+		ret[plain[storedKey]] = true
+	}
+	return ret, nil
+}
+
+func (self *Crypt) MapKey(length int, hash string) (int, string) {
+	storedLength, storedHash := self.storedKey(length, hash)
+	return hashbin.MapKey(self.backend, storedLength, storedHash)
+}
+
+// entries are named by stored keys, see MapKey
+func (self *Crypt) Flush() error {
+	return hashbin.Flush(self.backend)
+}
+
+// without the stored salt, see SaveSalt
+func (self *Crypt) List() ([]hashbin.Entry, error) {
+	entries, err := hashbin.List(self.backend)
+	if err != nil {
+		return nil, err
+	}
+	storedLength, storedHash := hashbin.MapKey(self.backend, SALT_LENGTH, saltHash())
+	ret := make([]hashbin.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Length == storedLength && entry.Hash == storedHash {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+func (self *Crypt) Delete(length int, hash string) error {
+	return hashbin.Delete(self.backend, length, hash)
+}
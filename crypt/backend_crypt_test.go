@@ -0,0 +1,90 @@
+package crypt
+
+import (
+	"../hashbin"
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"testing"
+)
+
+func TestCryptBackend(t *testing.T) {
+	key, err := DeriveKey("passphrase", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := hashbin.NewMembin()
+	crypt, err := New(mem, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(crypt)
+	hashbin.RunTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunContextTest(bin, t)
+	hashbin.RunExistsBatchTest(bin, t)
+
+	data := []byte("foobar")
+	hash := fmt.Sprintf("%x", sha512.Sum512(data))
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := mem.Exists(len(data), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("plaintext hash used as stored name")
+	}
+
+	// lengths are hidden in buckets
+	for length := 0; length < 1<<20; length += 997 {
+		size := paddedSize(length)
+		if size < length+LENGTH_SIZE || size > MIN_PADDED_SIZE && size > (length+LENGTH_SIZE)*9/8 {
+			t.Fatalf("bad padded size %d for %d", size, length)
+		}
+	}
+	storedLength, _ := crypt.storedKey(len(data), hash)
+	otherLength, _ := crypt.storedKey(len(data)+1, hash)
+	if storedLength != otherLength {
+		t.Fatal("plaintext length revealed")
+	}
+
+	// the salt is stored unencrypted and not listed
+	salt, err := LoadSalt(mem)
+	if err != nil || salt != nil {
+		t.Fatalf("salt loaded before saved: %v", err)
+	}
+	err = SaveSalt(mem, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, err = LoadSalt(mem)
+	if err != nil || string(salt) != "0123456789abcdef" {
+		t.Fatalf("salt not loaded: %v", err)
+	}
+	entries, err := bin.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Length == SALT_LENGTH {
+			t.Fatal("salt listed")
+		}
+	}
+
+	// wrong key
+	otherKey, err := DeriveKey("other", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(mem, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashbin.New(other).Fetch(len(data), hash, new(bytes.Buffer))
+	if err == nil {
+		t.Fatal("fetched with wrong key")
+	}
+}
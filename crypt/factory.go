@@ -0,0 +1,20 @@
+package crypt
+
+import (
+	"../hashbin"
+)
+
+func init() {
+	hashbin.RegisterFactory("crypt", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		backend, err := env.Open(spec.Param("backend", ""))
+		if err != nil {
+			return nil, err
+		}
+		var key []byte
+		err = env.Credential(spec, "key", "crypt_key", &key)
+		if err != nil {
+			return nil, err
+		}
+		return New(backend, key)
+	})
+}
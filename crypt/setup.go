@@ -0,0 +1,138 @@
+package crypt
+
+import (
+	"../hashbin"
+	"../register"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const SALT_LENGTH = 16
+
+func DeriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, KEY_LENGTH)
+}
+
+// the salt is stored unencrypted in the wrapped backend under a fixed key,
+// so the passphrase alone is needed to restore on another machine
+func saltHash() string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte("FileStore crypt salt")))
+}
+
+// nil if no salt is stored
+func LoadSalt(backend hashbin.Backend) ([]byte, error) {
+	exists, err := backend.Exists(SALT_LENGTH, saltHash())
+	if err != nil || !exists {
+		return nil, err
+	}
+	reader, cb, err := backend.NewReader(SALT_LENGTH, saltHash())
+	if err != nil {
+		return nil, err
+	}
+	salt, err := ioutil.ReadAll(reader)
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) != SALT_LENGTH {
+		return nil, errors.New("invalid stored salt")
+	}
+	return salt, nil
+}
+
+func SaveSalt(backend hashbin.Backend, salt []byte) error {
+	writer, cb, err := backend.NewWriter(SALT_LENGTH, saltHash())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, bytes.NewReader(salt))
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		return err
+	}
+	return hashbin.Flush(backend)
+}
+
+// backend is the wrapped one, the key is saved under the given register entry.
+// an existing key is never replaced, data encrypted with it would become unreadable
+func Setup(register *register.Register, backend hashbin.Backend, keyKey string) error {
+	var key []byte
+	if register.Get(keyKey, &key) == nil {
+		return errors.New(fmt.Sprintf("crypt key %s already set up", keyKey))
+	}
+	salt, err := LoadSalt(backend)
+	if err != nil {
+		return errors.New(fmt.Sprintf("load salt error: %v", err))
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	fmt.Printf("enter passphrase:\n")
+	// the whole line, passphrases may contain spaces
+	passphrase, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.New(fmt.Sprintf("passphrase error: %v", err))
+	}
+	passphrase = strings.TrimRight(passphrase, "\r\n")
+	if passphrase == "" {
+		return errors.New("empty passphrase")
+	}
+	if salt != nil {
+		fmt.Printf("using the salt stored in the backend\n")
+	} else {
+		fmt.Printf("enter salt in hex (empty to generate a new one):\n")
+		saltStr, _ := stdin.ReadString('\n')
+		saltStr = strings.TrimSpace(saltStr)
+		if saltStr == "" {
+			salt = make([]byte, SALT_LENGTH)
+			_, err = io.ReadFull(rand.Reader, salt)
+			if err != nil {
+				return err
+			}
+		} else {
+			salt, err = hex.DecodeString(saltStr)
+			if err != nil {
+				return errors.New(fmt.Sprintf("salt error: %v", err))
+			}
+			if len(salt) != SALT_LENGTH {
+				return errors.New(fmt.Sprintf("salt of %d bytes, %d expected", len(salt), SALT_LENGTH))
+			}
+		}
+		err = SaveSalt(backend, salt)
+		if err != nil {
+			return errors.New(fmt.Sprintf("save salt error: %v", err))
+		}
+	}
+
+	key, err = DeriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	err = register.Set(keyKey, key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("salt: %x\nthe salt is stored in the backend, keep the passphrase to restore on another machine\n", salt)
+	return nil
+}
+
+func LoadKey(register *register.Register) ([]byte, error) {
+	var key []byte
+	err := register.Get("crypt_key", &key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
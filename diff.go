@@ -0,0 +1,55 @@
+package main
+
+import (
+	"./snapshot"
+	"./utils"
+	"fmt"
+	"os"
+	"time"
+)
+
+func (self *App) runDiff() {
+	for _, flag := range self.flags {
+		fmt.Printf("unknown option %s\n", flag)
+		os.Exit(0)
+	}
+	if len(self.args) > 2 {
+		fmt.Printf("usage: %s diff [path] [snapshot] [snapshot]\n", os.Args[0])
+		os.Exit(0)
+	}
+	// compare the last two snapshots by default
+	selectors := []string{"-2", "-1"}
+	if len(self.args) == 1 {
+		selectors[0] = self.args[0]
+	} else if len(self.args) == 2 {
+		selectors = self.args
+	}
+	a, err := self.selectSnapshot(selectors[0])
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(0)
+	}
+	b, err := self.selectSnapshot(selectors[1])
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(0)
+	}
+	fmt.Printf("comparing snapshot %s with %s\n", a.Time.Format(time.RFC3339), b.Time.Format(time.RFC3339))
+
+	diff := snapshot.CompareSnapshots(a, b)
+	for _, path := range diff.Added {
+		fmt.Printf("+ %s\n", path)
+	}
+	for _, path := range diff.Deleted {
+		fmt.Printf("- %s\n", path)
+	}
+	for _, path := range diff.Changed {
+		fmt.Printf("C %s\n", path)
+	}
+	for _, path := range diff.Modified {
+		fmt.Printf("M %s\n", path)
+	}
+	fmt.Printf("%d added, %d deleted, %d changed, %d modified\n",
+		len(diff.Added), len(diff.Deleted), len(diff.Changed), len(diff.Modified))
+	fmt.Printf("%d new chunks, %s\n", diff.NewChunks, utils.FormatSize(int(diff.NewBytes)))
+}
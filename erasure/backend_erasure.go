@@ -0,0 +1,327 @@
+package erasure
+
+import (
+	"../hashbin"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// each chunk is split into data and parity shards, shard i is stored in backend i.
+// shards are stored with their own SHA-512 in front, corrupted ones count as missing
+type Erasure struct {
+	backends     []hashbin.Backend
+	dataShards   int
+	parityShards int
+	writeQuorum  int // shards to be saved for a successful write
+	encoder      reedsolomon.Encoder
+	// shard keys are not recoverable from backends storing objects under other keys
+	mapped bool
+}
+
+func New(backends []hashbin.Backend, dataShards, parityShards, writeQuorum int) (*Erasure, error) {
+	if dataShards <= 0 || parityShards < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid shards %d+%d", dataShards, parityShards))
+	}
+	if len(backends) != dataShards+parityShards {
+		return nil, errors.New(fmt.Sprintf("%d backends for %d shards", len(backends), dataShards+parityShards))
+	}
+	if writeQuorum < dataShards || writeQuorum > len(backends) {
+		return nil, errors.New(fmt.Sprintf("invalid write quorum %d", writeQuorum))
+	}
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	probe := fmt.Sprintf("%x", sha512.Sum512([]byte("FileStore erasure probe")))
+	mapped := false
+	for _, backend := range backends {
+		if length, hash := hashbin.MapKey(backend, len(probe), probe); length != len(probe) || hash != probe {
+			mapped = true
+		}
+	}
+	return &Erasure{
+		backends:     backends,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		writeQuorum:  writeQuorum,
+		encoder:      encoder,
+		mapped:       mapped,
+	}, nil
+}
+
+// shard keys keep the chunk key recoverable for List
+func (self *Erasure) shardKey(length int, hash string, i int) (int, string) {
+	shardSize := (length + self.dataShards - 1) / self.dataShards
+	return sha512.Size + shardSize, fmt.Sprintf("%s.%d.%d", hash, length, i)
+}
+
+func parseShardKey(hash string) (int, string, int, error) {
+	parts := strings.Split(hash, ".")
+	if len(parts) != 3 {
+		return 0, "", 0, errors.New(fmt.Sprintf("invalid shard key %s", hash))
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, "", 0, errors.New(fmt.Sprintf("invalid shard key %s", hash))
+	}
+	i, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, "", 0, errors.New(fmt.Sprintf("invalid shard key %s", hash))
+	}
+	return length, parts[0], i, nil
+}
+
+func (self *Erasure) split(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return make([][]byte, len(self.backends)), nil
+	}
+	shards, err := self.encoder.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	err = self.encoder.Encode(shards)
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+func saveShard(ctx context.Context, backend hashbin.Backend, length int, hash string, shard []byte) error {
+	writer, cb, err := hashbin.WithContext(backend).NewWriterContext(ctx, length, hash)
+	if err != nil {
+		return err
+	}
+	sum := sha512.Sum512(shard)
+	_, err = writer.Write(sum[:])
+	if err == nil {
+		_, err = writer.Write(shard)
+	}
+	if cb != nil {
+		err = cb(err)
+	}
+	return err
+}
+
+func (self *Erasure) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *Erasure) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	buf := new(bytes.Buffer)
+	return buf, func(err error) error {
+		if err != nil {
+			return err
+		}
+		shards, err := self.split(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		errs := make([]error, len(self.backends))
+		wg := new(sync.WaitGroup)
+		for i, backend := range self.backends {
+			wg.Add(1)
+			go func(i int, backend hashbin.Backend) {
+				defer wg.Done()
+				shardLength, shardHash := self.shardKey(length, hash, i)
+				errs[i] = saveShard(ctx, backend, shardLength, shardHash, shards[i])
+			}(i, backend)
+		}
+		wg.Wait()
+		saved := 0
+		messages := make([]string, 0)
+		for i, err := range errs {
+			if err == nil {
+				saved++
+			} else {
+				messages = append(messages, fmt.Sprintf("shard %d: %v", i, err))
+			}
+		}
+		if saved < self.writeQuorum {
+			return errors.New(fmt.Sprintf("saved %d of %d shards, quorum %d: %s",
+				saved, len(self.backends), self.writeQuorum, strings.Join(messages, "; ")))
+		}
+		return nil
+	}, nil
+}
+
+func fetchShard(ctx context.Context, backend hashbin.Backend, length int, hash string) ([]byte, error) {
+	reader, cb, err := hashbin.WithContext(backend).NewReaderContext(ctx, length, hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(length)+1))
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, errors.New("shard length not match")
+	}
+	sum := sha512.Sum512(data[sha512.Size:])
+	if !bytes.Equal(sum[:], data[:sha512.Size]) {
+		return nil, errors.New("shard corrupted")
+	}
+	return data[sha512.Size:], nil
+}
+
+// reconstructed from any data-shards-many shards
+func (self *Erasure) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *Erasure) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	shards := make([][]byte, len(self.backends))
+	errs := make([]error, len(self.backends))
+	wg := new(sync.WaitGroup)
+	for i, backend := range self.backends {
+		wg.Add(1)
+		go func(i int, backend hashbin.Backend) {
+			defer wg.Done()
+			shardLength, shardHash := self.shardKey(length, hash, i)
+			shards[i], errs[i] = fetchShard(ctx, backend, shardLength, shardHash)
+		}(i, backend)
+	}
+	wg.Wait()
+	fetched := 0
+	messages := make([]string, 0)
+	for i, err := range errs {
+		if err == nil {
+			fetched++
+		} else {
+			messages = append(messages, fmt.Sprintf("shard %d: %v", i, err))
+		}
+	}
+	if fetched < self.dataShards {
+		return nil, nil, errors.New(fmt.Sprintf("fetched %d of %d shards, %d needed: %s",
+			fetched, len(self.backends), self.dataShards, strings.Join(messages, "; ")))
+	}
+	if length == 0 {
+		return bytes.NewReader(nil), nil, nil
+	}
+	err := self.encoder.ReconstructData(shards)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := new(bytes.Buffer)
+	err = self.encoder.Join(data, shards, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
+
+// exists if at least the write quorum of shards exist
+func (self *Erasure) Exists(length int, hash string) (bool, error) {
+	return self.ExistsContext(context.Background(), length, hash)
+}
+
+func (self *Erasure) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	found := 0
+	answered := 0
+	var firstErr error
+	for i, backend := range self.backends {
+		shardLength, shardHash := self.shardKey(length, hash, i)
+		exists, err := hashbin.WithContext(backend).ExistsContext(ctx, shardLength, shardHash)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		answered++
+		if exists {
+			found++
+		}
+	}
+	if answered == 0 {
+		return false, firstErr
+	}
+	return found >= self.writeQuorum, nil
+}
+
+// flushes all backends, fails if any fails
+func (self *Erasure) Flush() error {
+	messages := make([]string, 0)
+	for i, backend := range self.backends {
+		err := hashbin.Flush(backend)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("backend %d: %v", i, err))
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(fmt.Sprintf("flush failed: %s", strings.Join(messages, "; ")))
+	}
+	return nil
+}
+
+func (self *Erasure) List() ([]hashbin.Entry, error) {
+	if self.mapped {
+		return nil, hashbin.ErrNotSupported
+	}
+	entries := make([]hashbin.Entry, 0)
+	seen := make(map[string]int)
+	for _, backend := range self.backends {
+		list, err := hashbin.List(backend)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list {
+			length, hash, _, err := parseShardKey(entry.Hash)
+			if err != nil { // not a shard
+				continue
+			}
+			key := fmt.Sprintf("%d-%s", length, hash)
+			i, ok := seen[key]
+			if !ok {
+				seen[key] = len(entries)
+				entries = append(entries, hashbin.Entry{
+					Length: length,
+					Hash:   hash,
+					Time:   entry.Time,
+				})
+				continue
+			}
+			// the most recent one, unknown times count as recent
+			if entries[i].Time.IsZero() || entry.Time.IsZero() {
+				entries[i].Time = time.Time{}
+			} else if entry.Time.After(entries[i].Time) {
+				entries[i].Time = entry.Time
+			}
+		}
+	}
+	return entries, nil
+}
+
+// deletes all shards, fails if none is deleted
+func (self *Erasure) Delete(length int, hash string) error {
+	if self.mapped {
+		return hashbin.ErrNotSupported
+	}
+	deleted := 0
+	messages := make([]string, 0)
+	for i, backend := range self.backends {
+		shardLength, shardHash := self.shardKey(length, hash, i)
+		err := hashbin.Delete(backend, shardLength, shardHash)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("shard %d: %v", i, err))
+			continue
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return errors.New(fmt.Sprintf("delete failed: %s", strings.Join(messages, "; ")))
+	}
+	return nil
+}
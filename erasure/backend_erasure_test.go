@@ -0,0 +1,135 @@
+package erasure
+
+import (
+	"../crypt"
+	"../hashbin"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// a shard backend that is down or returns corrupted data
+type faulty struct {
+	*hashbin.Membin
+	down    bool
+	corrupt bool
+}
+
+func (self *faulty) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	if self.down {
+		return nil, nil, errors.New("down")
+	}
+	return self.Membin.NewWriter(length, hash)
+}
+
+func (self *faulty) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	if self.down {
+		return nil, nil, errors.New("down")
+	}
+	if self.corrupt {
+		return bytes.NewReader(make([]byte, length)), nil, nil
+	}
+	return self.Membin.NewReader(length, hash)
+}
+
+func TestErasureBackend(t *testing.T) {
+	children := make([]*faulty, 5)
+	backends := make([]hashbin.Backend, 5)
+	for i := range children {
+		children[i] = &faulty{Membin: hashbin.NewMembin()}
+		backends[i] = children[i]
+	}
+	erasure, err := New(backends, 3, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(erasure)
+	hashbin.RunTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunRefTest(bin, t)
+	hashbin.RunContextTest(bin, t)
+
+	for _, size := range []int{0, 1, 1000, 1024*1024 + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		hash := fmt.Sprintf("%x", sha512.Sum512(data))
+		for _, child := range children {
+			child.down, child.corrupt = false, false
+		}
+
+		// tolerates one backend down on write
+		children[4].down = true
+		err = bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		children[4].down = false
+		exists, err := bin.Exists(len(data), hash)
+		if err != nil || !exists {
+			t.Fatalf("size %d: not exists", size)
+		}
+
+		// any three shards
+		err = bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		children[0].down = true
+		children[2].corrupt = true
+		buf := new(bytes.Buffer)
+		err = bin.Fetch(len(data), hash, buf)
+		if err != nil || !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("size %d: reconstruct: %v", size, err)
+		}
+		children[1].down = true
+		err = bin.Fetch(len(data), hash, new(bytes.Buffer))
+		if err == nil {
+			t.Fatalf("size %d: fetched with two shards", size)
+		}
+	}
+
+	// write quorum
+	for _, child := range children {
+		child.down, child.corrupt = false, false
+	}
+	children[0].down = true
+	children[1].down = true
+	data := []byte("foobar")
+	hash := fmt.Sprintf("%x", sha512.Sum512(data))
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("saved without quorum")
+	}
+
+	_, err = New(backends, 3, 1, 4)
+	if err == nil {
+		t.Fatal("shards not matching backends accepted")
+	}
+}
+
+// crypt stores objects under names that are not hashes of the stored data
+func TestCryptOver(t *testing.T) {
+	key, err := crypt.DeriveKey("passphrase", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]hashbin.Backend, 5)
+	for i := range backends {
+		backends[i] = hashbin.NewMembin()
+	}
+	erasure, err := New(backends, 3, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypted, err := crypt.New(erasure, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(crypted)
+	hashbin.RunTest(bin, t)
+	hashbin.RunRefTest(bin, t)
+}
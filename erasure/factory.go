@@ -0,0 +1,47 @@
+package erasure
+
+import (
+	"../hashbin"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	hashbin.RegisterFactory("erasure", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		backends := make([]hashbin.Backend, 0)
+		for _, name := range strings.Split(spec.Param("backends", ""), ",") {
+			backend, err := env.Open(strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, backend)
+		}
+		param := func(name string, def int) (int, error) {
+			n, err := strconv.Atoi(spec.Param(name, strconv.Itoa(def)))
+			if err != nil {
+				return 0, errors.New(fmt.Sprintf("invalid %s %s", name, spec.Param(name, "")))
+			}
+			return n, nil
+		}
+		data, err := param("data", len(backends)-1)
+		if err != nil {
+			return nil, err
+		}
+		parity, err := param("parity", 1)
+		if err != nil {
+			return nil, err
+		}
+		// one shard may be missing, and reading needs as many shards as data
+		defaultQuorum := data + parity - 1
+		if defaultQuorum < data {
+			defaultQuorum = data
+		}
+		quorum, err := param("quorum", defaultQuorum)
+		if err != nil {
+			return nil, err
+		}
+		return New(backends, data, parity, quorum)
+	})
+}
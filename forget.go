@@ -0,0 +1,139 @@
+package main
+
+import (
+	"./hashbin"
+	"./snapshot"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (self *App) runForget() {
+	policy := new(snapshot.Policy)
+	rules := map[string]*int{
+		"--keep-last=":    &policy.Last,
+		"--keep-hourly=":  &policy.Hourly,
+		"--keep-daily=":   &policy.Daily,
+		"--keep-weekly=":  &policy.Weekly,
+		"--keep-monthly=": &policy.Monthly,
+		"--keep-yearly=":  &policy.Yearly,
+	}
+	dryRun := false
+	yes := false
+	for _, flag := range self.flags {
+		if flag == "-n" || flag == "--dry-run" {
+			dryRun = true
+			continue
+		}
+		if flag == "-y" || flag == "--yes" {
+			yes = true
+			continue
+		}
+		matched := false
+		for prefix, target := range rules {
+			if strings.HasPrefix(flag, prefix) {
+				n, err := strconv.Atoi(strings.TrimPrefix(flag, prefix))
+				if err != nil || n < 0 {
+					fmt.Printf("invalid option %s\n", flag)
+					os.Exit(0)
+				}
+				*target = n
+				matched = true
+			}
+		}
+		if !matched {
+			fmt.Printf("unknown option %s\n", flag)
+			os.Exit(0)
+		}
+	}
+	if policy.Empty() && len(self.args) == 0 {
+		fmt.Printf("no retention rule or snapshot specified\n")
+		os.Exit(0)
+	}
+
+	snapshots := self.snapshotSet.Snapshots
+	drop := make(map[int]bool)
+	if !policy.Empty() {
+		keep := self.snapshotSet.Retain(policy)
+		for i := range snapshots {
+			if !keep[i] {
+				drop[i] = true
+			}
+		}
+	}
+	for _, selector := range self.args {
+		// a time not naming a snapshot only drops the nearest earlier one with --yes
+		selectSnapshot := self.snapshotSet.SelectExact
+		if yes {
+			selectSnapshot = self.snapshotSet.Select
+		}
+		i, err := selectSnapshot(selector)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(0)
+		}
+		drop[i] = true
+	}
+
+	for i, s := range snapshots {
+		action := "keep"
+		if drop[i] {
+			action = "drop"
+		}
+		fmt.Printf("%s\t%d\t%s\t%d files\n", action, i, s.Time.Format(time.RFC3339), len(s.Files))
+	}
+	fmt.Printf("%d snapshots to drop, %d to keep\n", len(drop), len(snapshots)-len(drop))
+	if dryRun || len(drop) == 0 {
+		return
+	}
+
+	self.snapshotSet.Remove(drop)
+	err := self.snapshotSet.Save(self.snapshotFilePath)
+	if err != nil {
+		log.Fatalf("cannot save snapshot to file: %v", err)
+	}
+	fmt.Printf("snapshots saved\n")
+
+	// a manifest still holding the dropped snapshots keeps their chunks from gc
+	failed := false
+	config, err := self.getConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := make([]string, 0, len(config.Backends))
+	for name := range config.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := self.openBackend(name)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			failed = true
+			continue
+		}
+		backend := hashbin.New(b)
+		exists, err := backend.RefExists(self.snapshotSet.Path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		if !exists {
+			continue
+		}
+		fmt.Printf("%s: ", name)
+		err = self.pushSnapshots(backend)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
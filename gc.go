@@ -0,0 +1,184 @@
+package main
+
+import (
+	"./hashbin"
+	"./snapshot"
+	"./utils"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (self *App) runGC() {
+	dryRun := false
+	grace := time.Hour * 24
+	for _, flag := range self.flags {
+		if flag == "-n" || flag == "--dry-run" {
+			dryRun = true
+		} else if strings.HasPrefix(flag, "--grace=") {
+			var err error
+			grace, err = time.ParseDuration(strings.TrimPrefix(flag, "--grace="))
+			if err != nil {
+				fmt.Printf("invalid option %s\n", flag)
+				os.Exit(0)
+			}
+		} else {
+			fmt.Printf("unknown option %s\n", flag)
+			os.Exit(0)
+		}
+	}
+
+	name, err := self.backendName()
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := self.openBackend(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend := hashbin.New(b)
+	referenced, err := self.referencedKeys(backend)
+	if err != nil {
+		log.Fatalf("collect referenced chunks: %v", err)
+	}
+	fmt.Printf("%d chunks referenced\n", len(referenced))
+
+	result, err := backend.Collect(referenced, grace, dryRun)
+	if err != nil {
+		log.Fatalf("gc error: %v", err)
+	}
+	fmt.Printf("%d kept, %d recent, %d deleted (%s), %d failed\n",
+		result.Kept, result.Recent, result.Deleted, utils.FormatSize(int(result.DeletedBytes)), result.Failed)
+	if dryRun {
+		fmt.Printf("dry run, nothing deleted\n")
+	} else if result.Deleted > 0 {
+		// deleted chunks may be referenced again by later snapshots,
+		// so journals of every backend sharing the storage are stale
+		err = self.removeJournals(name)
+		if err != nil {
+			fmt.Printf("remove upload journals: %v\n", err)
+		}
+	}
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func (self *App) removeJournals(name string) error {
+	collected, err := self.storageBackends(name)
+	if err != nil {
+		return err
+	}
+	config, err := self.getConfig()
+	if err != nil {
+		return err
+	}
+	for other := range config.Backends {
+		// a journal removed needlessly only costs a recheck
+		storage, err := self.storageBackends(other)
+		shared := err != nil
+		for n := range storage {
+			if collected[n] {
+				shared = true
+			}
+		}
+		if !shared {
+			continue
+		}
+		err = os.Remove(self.journalPath(other))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunks and manifests of every snapshot set in the data dir and in the backend,
+// since backends may be shared. fails if any manifest cannot be read,
+// deleting without knowing its chunks could lose data
+func (self *App) referencedKeys(backend *hashbin.Bin) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	add := func(chunks []*snapshot.Chunk) {
+		for _, chunk := range chunks {
+			referenced[fmt.Sprintf("%d-%s", chunk.Length, chunk.Hash)] = true
+		}
+	}
+	addFiles := func(snapshots []*snapshot.Snapshot) {
+		for _, s := range snapshots {
+			for _, file := range s.Files {
+				add(file.Chunks)
+			}
+		}
+	}
+
+	paths := make(map[string]bool)
+	infos, err := ioutil.ReadDir(self.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".snapshots") {
+			continue
+		}
+		path, err := url.QueryUnescape(strings.TrimSuffix(info.Name(), ".snapshots"))
+		if err != nil {
+			continue
+		}
+		set := &snapshot.SnapshotSet{
+			Path: path,
+		}
+		err = set.Load(filepath.Join(self.dataDir, info.Name()))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("load snapshots of %s: %v", path, err))
+		}
+		fmt.Printf("%s: %d snapshots\n", path, len(set.Snapshots))
+		addFiles(set.Snapshots)
+		paths[path] = true
+	}
+
+	remotePaths, pathsChunk, err := snapshot.RemotePaths(backend)
+	if err != nil {
+		return nil, err
+	}
+	if pathsChunk != nil {
+		length, hash := hashbin.RefKey(snapshot.PATHS_REF)
+		referenced[fmt.Sprintf("%d-%s", length, hash)] = true
+		add([]*snapshot.Chunk{pathsChunk})
+	}
+	for _, path := range remotePaths {
+		paths[path] = true
+	}
+
+	for path := range paths {
+		exists, err := backend.RefExists(path)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		length, hash := hashbin.RefKey(path)
+		referenced[fmt.Sprintf("%d-%s", length, hash)] = true
+		set := &snapshot.SnapshotSet{
+			Path: path,
+		}
+		chunks, err := set.ManifestChunks(backend)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("manifest of %s: %v", path, err))
+		}
+		add(chunks)
+		snapshots, _, err := set.Pull(backend)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("manifest of %s: %v", path, err))
+		}
+		fmt.Printf("%s: %d snapshots in manifest\n", path, len(snapshots))
+		addFiles(snapshots)
+	}
+	return referenced, nil
+}
@@ -5,39 +5,92 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 )
 
 type Membin struct {
+	sync.Mutex
 	store map[string][]byte
+	times map[string]time.Time
 }
 
 func NewMembin() *Membin {
 	return &Membin{
 		store: make(map[string][]byte),
+		times: make(map[string]time.Time),
 	}
 }
 
 func (self *Membin) NewWriter(length int, hash string) (io.Writer, Callback, error) {
-	buf := new(bytes.Buffer)
+	buf := bytes.NewBuffer(make([]byte, 0, length))
 	return buf, func(err error) error {
 		if err != nil {
 			return err
 		}
-		self.store[fmt.Sprintf("%d-%s", length, hash)] = buf.Bytes()
+		key := fmt.Sprintf("%d-%s", length, hash)
+		self.Lock()
+		defer self.Unlock()
+		self.store[key] = buf.Bytes()
+		self.times[key] = time.Now()
 		return nil
 	}, nil
 }
 
 func (self *Membin) NewReader(length int, hash string) (io.Reader, Callback, error) {
+	self.Lock()
+	defer self.Unlock()
 	if v, ok := self.store[fmt.Sprintf("%d-%s", length, hash)]; ok {
 		return bytes.NewReader(v), nil, nil
 	}
 	return nil, nil, errors.New("not exists")
 }
 
+func (self *Membin) NewRangeReader(length int, hash string, offset, size int) (io.Reader, Callback, error) {
+	self.Lock()
+	defer self.Unlock()
+	v, ok := self.store[fmt.Sprintf("%d-%s", length, hash)]
+	if !ok {
+		return nil, nil, errors.New("not exists")
+	}
+	if offset < 0 || size < 0 || offset+size > len(v) {
+		return nil, nil, errors.New("range out of bounds")
+	}
+	return bytes.NewReader(v[offset : offset+size]), nil, nil
+}
+
 func (self *Membin) Exists(length int, hash string) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
 	if _, ok := self.store[fmt.Sprintf("%d-%s", length, hash)]; ok {
 		return true, nil
 	}
 	return false, nil
 }
+
+func (self *Membin) List() ([]Entry, error) {
+	self.Lock()
+	defer self.Unlock()
+	entries := make([]Entry, 0, len(self.store))
+	for key := range self.store {
+		length, hash, err := ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			Length: length,
+			Hash:   hash,
+			Time:   self.times[key],
+		})
+	}
+	return entries, nil
+}
+
+func (self *Membin) Delete(length int, hash string) error {
+	self.Lock()
+	defer self.Unlock()
+	key := fmt.Sprintf("%d-%s", length, hash)
+	delete(self.store, key)
+	delete(self.times, key)
+	return nil
+}
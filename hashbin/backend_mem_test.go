@@ -8,4 +8,9 @@ func TestMemBackend(t *testing.T) {
 	mem := NewMembin()
 	bin := New(mem)
 	RunTest(bin, t)
+	RunRefTest(bin, t)
+	RunListTest(bin, t)
+	RunRangeTest(bin, t)
+	RunContextTest(bin, t)
+	RunExistsBatchTest(bin, t)
 }
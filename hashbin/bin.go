@@ -1,6 +1,7 @@
 package hashbin
 
 import (
+	"context"
 	"crypto/sha512"
 	"errors"
 	"fmt"
@@ -25,9 +26,16 @@ type Backend interface {
 	Exists(length int, hash string) (bool, error)
 }
 
-func (self *Bin) Save(length int, hash string, reader io.Reader) (err error) {
-	writer, cb, err := self.backend.NewWriter(length, hash)
+func (self *Bin) Save(length int, hash string, reader io.Reader) error {
+	return self.SaveContext(context.Background(), length, hash, reader)
+}
+
+func (self *Bin) SaveContext(ctx context.Context, length int, hash string, reader io.Reader) (err error) {
+	writer, cb, err := WithContext(self.backend).NewWriterContext(ctx, length, hash)
 	if err != nil {
+		if IsPermanent(err) {
+			return err
+		}
 		return errors.New(fmt.Sprintf("backend error %v", err))
 	}
 	if cb != nil {
@@ -40,13 +48,17 @@ func (self *Bin) Save(length int, hash string, reader io.Reader) (err error) {
 		return err
 	}
 	if n != length || !(h == hash) {
-		return errors.New(fmt.Sprintf("data not match %d-%s", length, hash))
+		return Permanent(errors.New(fmt.Sprintf("data not match %d-%s", length, hash)))
 	}
 	return nil
 }
 
-func (self *Bin) Fetch(length int, hash string, writer io.Writer) (err error) {
-	reader, cb, err := self.backend.NewReader(length, hash)
+func (self *Bin) Fetch(length int, hash string, writer io.Writer) error {
+	return self.FetchContext(context.Background(), length, hash, writer)
+}
+
+func (self *Bin) FetchContext(ctx context.Context, length int, hash string, writer io.Writer) (err error) {
+	reader, cb, err := WithContext(self.backend).NewReaderContext(ctx, length, hash)
 	if err != nil {
 		return errors.New(fmt.Sprintf("backend error %v", err))
 	}
@@ -81,7 +93,12 @@ func pipe(reader io.Reader, writer io.Writer) (int, string, error) {
 			hasher.Write(buf[:n])
 			_, err = writer.Write(buf[:n])
 			if err != nil {
-				return readN, fmt.Sprintf("%x", hasher.Sum(nil)), errors.New(fmt.Sprintf("writer write error %v", err))
+				// a streaming backend may fail the write with its own permanent error
+				e := errors.New(fmt.Sprintf("writer write error %v", err))
+				if IsPermanent(err) {
+					e = Permanent(e)
+				}
+				return readN, fmt.Sprintf("%x", hasher.Sum(nil)), e
 			}
 		}
 		if err == io.EOF {
@@ -96,3 +113,7 @@ func pipe(reader io.Reader, writer io.Writer) (int, string, error) {
 func (self *Bin) Exists(length int, hash string) (bool, error) {
 	return self.backend.Exists(length, hash)
 }
+
+func (self *Bin) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	return WithContext(self.backend).ExistsContext(ctx, length, hash)
+}
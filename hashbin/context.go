@@ -0,0 +1,87 @@
+package hashbin
+
+import (
+	"context"
+	"io"
+)
+
+// backends that can be cancelled or given a deadline
+type ContextBackend interface {
+	NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, Callback, error)
+	NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, Callback, error)
+	ExistsContext(ctx context.Context, length int, hash string) (bool, error)
+}
+
+// backends without context support are checked between reads and writes,
+// and a cancelled write is not committed
+func WithContext(backend Backend) ContextBackend {
+	if b, ok := backend.(ContextBackend); ok {
+		return b
+	}
+	return &contextAdapter{backend}
+}
+
+type contextAdapter struct {
+	backend Backend
+}
+
+func (self *contextAdapter) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, Callback, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, Permanent(err)
+	}
+	writer, cb, err := self.backend.NewWriter(length, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &contextWriter{ctx, writer}, func(err error) error {
+		if err == nil && ctx.Err() != nil {
+			err = Permanent(ctx.Err())
+		}
+		if cb != nil {
+			return cb(err)
+		}
+		return err
+	}, nil
+}
+
+func (self *contextAdapter) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, Callback, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	reader, cb, err := self.backend.NewReader(length, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &contextReader{ctx, reader}, cb, nil
+}
+
+func (self *contextAdapter) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return self.backend.Exists(length, hash)
+}
+
+type contextWriter struct {
+	ctx    context.Context
+	writer io.Writer
+}
+
+func (self *contextWriter) Write(p []byte) (int, error) {
+	if err := self.ctx.Err(); err != nil {
+		return 0, Permanent(err)
+	}
+	return self.writer.Write(p)
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (self *contextReader) Read(p []byte) (int, error) {
+	if err := self.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return self.reader.Read(p)
+}
@@ -0,0 +1,81 @@
+package hashbin
+
+import (
+	"context"
+	"sync"
+)
+
+// implemented by backends able to check many objects at once.
+// keys are "length-hash", the result holds the present ones
+type BatchExister interface {
+	ExistsBatch(ctx context.Context, keys []string) (map[string]bool, error)
+}
+
+const EXISTS_WORKERS = 16
+
+// backends without batch support are queried by concurrent Exists calls
+func ExistsBatch(ctx context.Context, backend Backend, keys []string) (map[string]bool, error) {
+	if b, ok := backend.(BatchExister); ok {
+		return b.ExistsBatch(ctx, keys)
+	}
+	return ExistsConcurrently(ctx, keys, EXISTS_WORKERS, WithContext(backend).ExistsContext)
+}
+
+// query keys with workers calls to exists at a time, stopping at the first error
+func ExistsConcurrently(ctx context.Context, keys []string, workers int,
+	exists func(ctx context.Context, length int, hash string) (bool, error)) (map[string]bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	present := make(map[string]bool)
+	var firstErr error
+	lock := new(sync.Mutex)
+	jobs := make(chan string)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				length, hash, err := ParseKey(key)
+				var ok bool
+				if err == nil {
+					ok, err = exists(ctx, length, hash)
+				}
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				if ok {
+					present[key] = true
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+loop:
+	for _, key := range keys {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return present, nil
+}
+
+func (self *Bin) ExistsBatch(keys []string) (map[string]bool, error) {
+	return self.ExistsBatchContext(context.Background(), keys)
+}
+
+func (self *Bin) ExistsBatchContext(ctx context.Context, keys []string) (map[string]bool, error) {
+	return ExistsBatch(ctx, self.backend, keys)
+}
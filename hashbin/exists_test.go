@@ -0,0 +1,39 @@
+package hashbin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fails exists calls
+type broken struct {
+	*Membin
+}
+
+func (self *broken) Exists(length int, hash string) (bool, error) {
+	return false, errors.New("broken")
+}
+
+func TestExistsBatch(t *testing.T) {
+	_, err := New(&broken{NewMembin()}).ExistsBatch([]string{"1-a", "2-b"})
+	if err == nil {
+		t.Fatal("error not reported")
+	}
+	_, err = New(NewMembin()).ExistsBatch([]string{"foo"})
+	if err == nil {
+		t.Fatal("invalid key accepted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	keys := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("%d-a", i))
+	}
+	_, err = New(NewMembin()).ExistsBatchContext(ctx, keys)
+	if err == nil {
+		t.Fatal("cancelled batch not reported")
+	}
+}
@@ -0,0 +1,76 @@
+package hashbin
+
+import (
+	"errors"
+	"fmt"
+)
+
+// backends constructible from configuration
+
+type Spec struct {
+	Type   string            `json:"type"`
+	Params map[string]string `json:"params"`
+	// names of register entries holding credentials
+	Credentials map[string]string `json:"credentials"`
+}
+
+type Credentials interface {
+	Get(key string, target interface{}) error
+}
+
+type Env struct {
+	Name        string // of the configured backend
+	DataDir     string
+	Credentials Credentials
+	// other configured backends, for backends wrapping another one
+	Open func(name string) (Backend, error)
+}
+
+type Factory func(spec *Spec, env *Env) (Backend, error)
+
+var factories = make(map[string]Factory)
+
+func RegisterFactory(backendType string, factory Factory) {
+	if _, ok := factories[backendType]; ok {
+		panic(fmt.Sprintf("backend type %s registered twice", backendType))
+	}
+	factories[backendType] = factory
+}
+
+func NewBackend(spec *Spec, env *Env) (Backend, error) {
+	factory, ok := factories[spec.Type]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown backend type %s", spec.Type))
+	}
+	return factory(spec, env)
+}
+
+func (self *Spec) Param(name, def string) string {
+	if value, ok := self.Params[name]; ok {
+		return value
+	}
+	return def
+}
+
+// the register entry configured for the credential name, or the default entry
+func (self *Spec) CredentialKey(name, def string) string {
+	if key, ok := self.Credentials[name]; ok {
+		return key
+	}
+	return def
+}
+
+// load the credential from the register entry of CredentialKey
+func (self *Env) Credential(spec *Spec, name, def string, target interface{}) error {
+	key := spec.CredentialKey(name, def)
+	if self.Credentials == nil {
+		return errors.New(fmt.Sprintf("no credentials for %s", key))
+	}
+	return self.Credentials.Get(key, target)
+}
+
+func init() {
+	RegisterFactory("mem", func(spec *Spec, env *Env) (Backend, error) {
+		return NewMembin(), nil
+	})
+}
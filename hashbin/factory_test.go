@@ -0,0 +1,82 @@
+package hashbin
+
+import (
+	"errors"
+	"testing"
+)
+
+type mapCredentials map[string]string
+
+func (self mapCredentials) Get(key string, target interface{}) error {
+	value, ok := self[key]
+	if !ok {
+		return errors.New("key not found")
+	}
+	*target.(*string) = value
+	return nil
+}
+
+type wrapped struct {
+	Backend
+	secret string
+}
+
+// registered once, tests may run more than once
+func init() {
+	RegisterFactory("test-wrap", func(spec *Spec, env *Env) (Backend, error) {
+		inner, err := env.Open(spec.Param("backend", ""))
+		if err != nil {
+			return nil, err
+		}
+		var secret string
+		err = env.Credential(spec, "secret", "default_secret", &secret)
+		if err != nil {
+			return nil, err
+		}
+		return &wrapped{inner, secret}, nil
+	})
+}
+
+func TestFactory(t *testing.T) {
+	specs := map[string]*Spec{
+		"mem": &Spec{Type: "mem"},
+		"wrap": &Spec{
+			Type:        "test-wrap",
+			Params:      map[string]string{"backend": "mem"},
+			Credentials: map[string]string{"secret": "my_secret"},
+		},
+	}
+	env := &Env{
+		Credentials: mapCredentials{"my_secret": "foo", "default_secret": "bar"},
+	}
+	env.Open = func(name string) (Backend, error) {
+		return NewBackend(specs[name], env)
+	}
+
+	backend, err := env.Open("wrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, ok := backend.(*wrapped)
+	if !ok || w.secret != "foo" {
+		t.Fatal("credential not loaded from configured key")
+	}
+	if _, ok := w.Backend.(*Membin); !ok {
+		t.Fatal("inner backend not opened")
+	}
+	RunTest(New(backend), t)
+
+	if specs["wrap"].CredentialKey("secret", "default_secret") != "my_secret" {
+		t.Fatal("configured credential key not used")
+	}
+	delete(specs["wrap"].Credentials, "secret")
+	backend, err = env.Open("wrap")
+	if err != nil || backend.(*wrapped).secret != "bar" {
+		t.Fatal("credential not loaded from default key")
+	}
+
+	_, err = NewBackend(&Spec{Type: "unknown"}, env)
+	if err == nil {
+		t.Fatal("unknown type accepted")
+	}
+}
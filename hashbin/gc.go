@@ -0,0 +1,122 @@
+package hashbin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"time"
+)
+
+// points to an object changed by every collection, so clients remembering
+// which objects a backend has can tell when to forget them
+const GENERATION_REF = ":gc"
+
+type CollectResult struct {
+	Kept         int
+	Recent       int
+	Deleted      int
+	DeletedBytes int64
+	Failed       int
+}
+
+// the current generation, empty if never collected
+func (self *Bin) Generation() (string, error) {
+	exists, err := self.RefExists(GENERATION_REF)
+	if err != nil || !exists {
+		return "", err
+	}
+	_, hash, err := self.LoadRef(GENERATION_REF)
+	return hash, err
+}
+
+// saves a new generation, returns the keys of its ref and object
+func (self *Bin) newGeneration() ([]string, error) {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, time.Now().String()...)
+	hash := fmt.Sprintf("%x", sha512.Sum512(data))
+	err = self.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	err = self.Flush()
+	if err != nil {
+		return nil, err
+	}
+	err = self.SaveRef(GENERATION_REF, len(data), hash)
+	if err != nil {
+		return nil, err
+	}
+	length, refHash := RefKey(GENERATION_REF)
+	return []string{
+		fmt.Sprintf("%d-%s", length, refHash),
+		fmt.Sprintf("%d-%s", len(data), hash),
+	}, nil
+}
+
+// delete stored objects not in referenced, which holds "length-hash" keys.
+// objects written within grace are kept.
+// a new generation is saved before anything is deleted
+func (self *Bin) Collect(referenced map[string]bool, grace time.Duration, dryRun bool) (*CollectResult, error) {
+	keys := make([]string, 0, len(referenced))
+	for key := range referenced {
+		keys = append(keys, key)
+	}
+	if !dryRun {
+		generation, err := self.newGeneration()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, generation...)
+	}
+	keep := make(map[string]bool)
+	for _, key := range keys {
+		length, hash, err := ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		length, hash = MapKey(self.backend, length, hash)
+		keep[fmt.Sprintf("%d-%s", length, hash)] = true
+	}
+
+	entries, err := self.List()
+	if err != nil {
+		return nil, err
+	}
+	result := new(CollectResult)
+	deadline := time.Now().Add(-grace)
+	for _, entry := range entries {
+		if keep[fmt.Sprintf("%d-%s", entry.Length, entry.Hash)] {
+			result.Kept++
+			continue
+		}
+		if entry.Time.IsZero() || entry.Time.After(deadline) {
+			result.Recent++
+			continue
+		}
+		if dryRun {
+			fmt.Printf("would delete %d-%s\n", entry.Length, entry.Hash)
+		} else {
+			err = self.Delete(entry.Length, entry.Hash)
+			if err != nil {
+				fmt.Printf("delete %d-%s error: %v\n", entry.Length, entry.Hash, err)
+				result.Failed++
+				continue
+			}
+			fmt.Printf("deleted %d-%s\n", entry.Length, entry.Hash)
+		}
+		result.Deleted++
+		result.DeletedBytes += int64(entry.Length)
+	}
+	if !dryRun && result.Deleted > 0 {
+		err = self.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package hashbin
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCollect(t *testing.T) {
+	mem := NewMembin()
+	bin := New(mem)
+	referenced := make(map[string]bool)
+	var keys []string
+	for i := 0; i < 4; i++ {
+		data := genRandBytes(1024)
+		hash := hashBytes(data)
+		err := bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("%d-%s", len(data), hash)
+		keys = append(keys, key)
+		if i < 2 {
+			referenced[key] = true
+		}
+	}
+	// the last one is recent
+	for _, key := range keys[:3] {
+		mem.times[key] = time.Now().Add(-time.Hour * 48)
+	}
+
+	result, err := bin.Collect(referenced, time.Hour*24, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Kept != 2 || result.Recent != 1 || result.Deleted != 1 || len(mem.store) != 4 {
+		t.Fatalf("dry run incorrect %+v", result)
+	}
+
+	generation, err := bin.Generation()
+	if err != nil || generation != "" {
+		t.Fatalf("generation before collect: %v", err)
+	}
+	result, err = bin.Collect(referenced, time.Hour*24, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and the generation ref and object
+	if result.Deleted != 1 || len(mem.store) != 5 {
+		t.Fatalf("collect incorrect %+v", result)
+	}
+	if _, ok := mem.store[keys[2]]; ok {
+		t.Fatal("unreferenced data not deleted")
+	}
+	generation, err = bin.Generation()
+	if err != nil || generation == "" {
+		t.Fatalf("generation not saved: %v", err)
+	}
+
+	// the previous generation object is deleted, with the formerly recent one
+	for key := range mem.times {
+		mem.times[key] = time.Now().Add(-time.Hour * 48)
+	}
+	result, err = bin.Collect(referenced, time.Hour*24, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted != 2 || len(mem.store) != 4 {
+		t.Fatalf("collect incorrect %+v", result)
+	}
+	next, err := bin.Generation()
+	if err != nil || next == generation {
+		t.Fatal("generation not changed")
+	}
+}
@@ -0,0 +1,105 @@
+package hashbin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// optional capabilities of backends
+
+type Entry struct {
+	Length int
+	Hash   string
+	Time   time.Time
+}
+
+type Lister interface {
+	List() ([]Entry, error)
+}
+
+type Deleter interface {
+	Delete(length int, hash string) error
+}
+
+// implemented by backends storing objects under keys other than the given ones
+type Mapper interface {
+	MapKey(length int, hash string) (int, string)
+}
+
+// implemented by backends buffering writes or caching state
+type Flusher interface {
+	Flush() error
+}
+
+// implemented by backends able to read a part of an object
+type RangeReader interface {
+	NewRangeReader(length int, hash string, offset, size int) (io.Reader, Callback, error)
+}
+
+var ErrNotSupported = errors.New("not supported by backend")
+
+func List(backend Backend) ([]Entry, error) {
+	if lister, ok := backend.(Lister); ok {
+		return lister.List()
+	}
+	return nil, ErrNotSupported
+}
+
+func Delete(backend Backend, length int, hash string) error {
+	if deleter, ok := backend.(Deleter); ok {
+		return deleter.Delete(length, hash)
+	}
+	return ErrNotSupported
+}
+
+func MapKey(backend Backend, length int, hash string) (int, string) {
+	if mapper, ok := backend.(Mapper); ok {
+		return mapper.MapKey(length, hash)
+	}
+	return length, hash
+}
+
+// backends not buffering anything need no flush
+func Flush(backend Backend) error {
+	if flusher, ok := backend.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func NewRangeReader(backend Backend, length int, hash string, offset, size int) (io.Reader, Callback, error) {
+	if r, ok := backend.(RangeReader); ok {
+		return r.NewRangeReader(length, hash, offset, size)
+	}
+	return nil, nil, ErrNotSupported
+}
+
+func ParseKey(key string) (int, string, error) {
+	parts := strings.SplitN(key, "-", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", errors.New(fmt.Sprintf("invalid key %s", key))
+	}
+	length, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", errors.New(fmt.Sprintf("invalid key %s", key))
+	}
+	return length, parts[1], nil
+}
+
+func (self *Bin) List() ([]Entry, error) {
+	return List(self.backend)
+}
+
+// delete by a stored key as returned by List
+func (self *Bin) Delete(length int, hash string) error {
+	return Delete(self.backend, length, hash)
+}
+
+// make saved objects durable
+func (self *Bin) Flush() error {
+	return Flush(self.backend)
+}
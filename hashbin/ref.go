@@ -0,0 +1,65 @@
+package hashbin
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// a ref is a small mutable object with a well-known key, pointing to a content object
+const REF_LENGTH = 16 + sha512.Size*2
+
+func refHash(name string) string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte("FileStore ref "+name)))
+}
+
+func RefKey(name string) (int, string) {
+	return REF_LENGTH, refHash(name)
+}
+
+func (self *Bin) SaveRef(name string, length int, hash string) (err error) {
+	if len(hash) != sha512.Size*2 {
+		return errors.New(fmt.Sprintf("invalid hash %s", hash))
+	}
+	writer, cb, err := self.backend.NewWriter(REF_LENGTH, refHash(name))
+	if err != nil {
+		return errors.New(fmt.Sprintf("backend error %v", err))
+	}
+	if cb != nil {
+		defer func() {
+			err = cb(err)
+		}()
+	}
+	_, err = fmt.Fprintf(writer, "%016x%s", length, hash)
+	return err
+}
+
+func (self *Bin) LoadRef(name string) (length int, hash string, err error) {
+	reader, cb, err := self.backend.NewReader(REF_LENGTH, refHash(name))
+	if err != nil {
+		return 0, "", errors.New(fmt.Sprintf("backend error %v", err))
+	}
+	if cb != nil {
+		defer func() {
+			err = cb(err)
+		}()
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(data) != REF_LENGTH {
+		return 0, "", errors.New(fmt.Sprintf("invalid ref %s", name))
+	}
+	l, err := strconv.ParseInt(string(data[:16]), 16, 64)
+	if err != nil {
+		return 0, "", errors.New(fmt.Sprintf("invalid ref %s", name))
+	}
+	return int(l), string(data[16:]), nil
+}
+
+func (self *Bin) RefExists(name string) (bool, error) {
+	return self.backend.Exists(REF_LENGTH, refHash(name))
+}
@@ -0,0 +1,100 @@
+package hashbin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration // before the second attempt, doubled after each one
+	MaxBackoff time.Duration
+	Jitter     float64 // randomize each backoff by up to this fraction
+}
+
+var DefaultRetryPolicy = &RetryPolicy{
+	Attempts:   5,
+	Backoff:    time.Second * 2,
+	MaxBackoff: time.Minute,
+	Jitter:     0.3,
+}
+
+// errors that retrying will not fix
+type PermanentError struct {
+	Err error
+}
+
+func (self *PermanentError) Error() string {
+	return self.Err.Error()
+}
+
+func Permanent(err error) error {
+	if err == nil || IsPermanent(err) {
+		return err
+	}
+	return &PermanentError{err}
+}
+
+func IsPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// returns early when ctx is done
+var sleep = func(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func (self *RetryPolicy) backoff(attempt int) time.Duration {
+	d := self.Backoff
+	for i := 1; i < attempt && d < self.MaxBackoff; i++ {
+		d *= 2
+	}
+	if self.MaxBackoff > 0 && d > self.MaxBackoff {
+		d = self.MaxBackoff
+	}
+	if self.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * self.Jitter * float64(d))
+	}
+	return d
+}
+
+// save with retries, returns the number of attempts made
+func (self *Bin) SaveRetry(length int, hash string, reader io.ReadSeeker, policy *RetryPolicy) (int, error) {
+	return self.SaveRetryContext(context.Background(), length, hash, reader, policy)
+}
+
+func (self *Bin) SaveRetryContext(ctx context.Context, length int, hash string, reader io.ReadSeeker, policy *RetryPolicy) (int, error) {
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	var err error
+	attempt := 0
+	for attempt < policy.Attempts || attempt == 0 {
+		if attempt > 0 {
+			sleep(ctx, policy.backoff(attempt))
+			if ctx.Err() != nil {
+				return attempt, err
+			}
+		}
+		attempt++
+		_, err = reader.Seek(0, 0)
+		if err != nil {
+			return attempt, Permanent(err)
+		}
+		err = self.SaveContext(ctx, length, hash, reader)
+		if err == nil || IsPermanent(err) {
+			return attempt, err
+		}
+	}
+	return attempt, errors.New(fmt.Sprintf("%v, gave up after %d attempts", err, attempt))
+}
@@ -0,0 +1,94 @@
+package hashbin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fails the first writes
+type flaky struct {
+	*Membin
+	failures int
+	err      error
+	writes   int
+}
+
+func (self *flaky) NewWriter(length int, hash string) (io.Writer, Callback, error) {
+	self.writes++
+	if self.writes <= self.failures {
+		return nil, nil, self.err
+	}
+	return self.Membin.NewWriter(length, hash)
+}
+
+func TestSaveRetry(t *testing.T) {
+	var slept []time.Duration
+	realSleep := sleep
+	sleep = func(ctx context.Context, d time.Duration) {
+		slept = append(slept, d)
+	}
+	defer func() {
+		sleep = realSleep
+	}()
+	policy := &RetryPolicy{
+		Attempts:   4,
+		Backoff:    time.Second,
+		MaxBackoff: time.Second * 3,
+	}
+	data := genRandBytes(1024)
+	hash := hashBytes(data)
+
+	// retryable
+	backend := &flaky{Membin: NewMembin(), failures: 2, err: errors.New("timeout")}
+	bin := New(backend)
+	attempts, err := bin.SaveRetry(len(data), hash, bytes.NewReader(data), policy)
+	if err != nil || attempts != 3 {
+		t.Fatalf("save retry: %d %v", attempts, err)
+	}
+	if len(slept) != 2 || slept[0] != time.Second || slept[1] != time.Second*2 {
+		t.Fatalf("backoff %v", slept)
+	}
+	exists, err := bin.Exists(len(data), hash)
+	if err != nil || !exists {
+		t.Fatal("not saved")
+	}
+
+	// give up
+	slept = nil
+	backend = &flaky{Membin: NewMembin(), failures: 10, err: errors.New("timeout")}
+	attempts, err = New(backend).SaveRetry(len(data), hash, bytes.NewReader(data), policy)
+	if err == nil || attempts != 4 || backend.writes != 4 {
+		t.Fatalf("no give up: %d %v", attempts, err)
+	}
+	if slept[2] != time.Second*3 {
+		t.Fatalf("max backoff %v", slept)
+	}
+
+	// permanent
+	backend = &flaky{Membin: NewMembin(), failures: 10, err: Permanent(errors.New("forbidden"))}
+	attempts, err = New(backend).SaveRetry(len(data), hash, bytes.NewReader(data), policy)
+	if !IsPermanent(err) || attempts != 1 {
+		t.Fatalf("permanent error retried: %d %v", attempts, err)
+	}
+	data[0]++
+	attempts, err = New(NewMembin()).SaveRetry(len(data), hash, bytes.NewReader(data), policy)
+	if !IsPermanent(err) || attempts != 1 {
+		t.Fatalf("hash mismatch retried: %d %v", attempts, err)
+	}
+	data[0]--
+
+	// cancelled while backing off
+	ctx, cancel := context.WithCancel(context.Background())
+	sleep = func(ctx context.Context, d time.Duration) {
+		cancel()
+	}
+	backend = &flaky{Membin: NewMembin(), failures: 10, err: errors.New("timeout")}
+	attempts, err = New(backend).SaveRetryContext(ctx, len(data), hash, bytes.NewReader(data), policy)
+	if err == nil || attempts != 1 || backend.writes != 1 {
+		t.Fatalf("retried after cancel: %d %v", attempts, err)
+	}
+}
@@ -0,0 +1,54 @@
+package hashbin
+
+import (
+	"errors"
+	"io"
+)
+
+// a writer feeding upload, which runs in the background.
+// the reader yields exactly length bytes and reaches EOF only when the callback
+// is called without error, so upload must not commit before reading to the end
+func NewPipeWriter(length int, upload func(io.Reader) error) (io.Writer, Callback) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := upload(&exactReader{reader, length})
+		// fail further writes if upload returned early
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	return writer, func(err error) error {
+		if err != nil {
+			writer.CloseWithError(err)
+			<-done
+			return err
+		}
+		writer.Close()
+		return <-done
+	}
+}
+
+type exactReader struct {
+	reader io.Reader
+	left   int
+}
+
+func (self *exactReader) Read(p []byte) (int, error) {
+	if self.left == 0 {
+		// wait for the writer to close
+		n, err := self.reader.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, errors.New("data longer than expected")
+		}
+		return 0, err
+	}
+	if len(p) > self.left {
+		p = p[:self.left]
+	}
+	n, err := self.reader.Read(p)
+	self.left -= n
+	if err == io.EOF && self.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
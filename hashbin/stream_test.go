@@ -0,0 +1,78 @@
+package hashbin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// commits what the pipe reader yields
+type streamed struct {
+	*Membin
+	err error // returned by uploads before reading
+}
+
+func (self *streamed) NewWriter(length int, hash string) (io.Writer, Callback, error) {
+	writer, cb := NewPipeWriter(length, func(reader io.Reader) error {
+		if self.err != nil {
+			return self.err
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		w, cb, _ := self.Membin.NewWriter(length, hash)
+		w.Write(data)
+		return cb(nil)
+	})
+	return writer, cb, nil
+}
+
+func TestPipeWriter(t *testing.T) {
+	backend := &streamed{Membin: NewMembin()}
+	bin := New(backend)
+	data := genRandBytes(3*1024*1024 + 42)
+	hash := hashBytes(data)
+
+	err := bin.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _ := bin.Exists(len(data), hash)
+	if !exists {
+		t.Fatal("not saved")
+	}
+
+	// not committed when the hash check fails
+	backend.Membin = NewMembin()
+	other := genRandBytes(len(data))
+	err = bin.Save(len(other), hash, bytes.NewReader(other))
+	if err == nil || !IsPermanent(err) {
+		t.Fatalf("mismatch not reported: %v", err)
+	}
+	if len(backend.store) > 0 {
+		t.Fatal("mismatched data committed")
+	}
+
+	// longer and shorter data
+	err = bin.Save(len(data)-1, hashBytes(data[:len(data)-1]), bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("longer data saved")
+	}
+	err = bin.Save(len(data)+1, hash, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("shorter data saved")
+	}
+	if len(backend.store) > 0 {
+		t.Fatal("data of wrong length committed")
+	}
+
+	// upload errors reach the caller
+	backend.err = Permanent(errors.New("denied"))
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err == nil || !IsPermanent(err) {
+		t.Fatalf("upload error not reported: %v", err)
+	}
+}
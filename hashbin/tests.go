@@ -2,6 +2,7 @@ package hashbin
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"fmt"
 	"math/rand"
@@ -75,3 +76,178 @@ func hashBytes(bs []byte) string {
 	hasher.Write(bs)
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
+
+func RunRefTest(bin *Bin, t *testing.T) {
+	for i := 0; i < 2; i++ {
+		data := genRandBytes(1024)
+		hash := hashBytes(data)
+		err := bin.SaveRef("foo", len(data), hash)
+		if err != nil {
+			t.Fatalf("save ref error: %v", err)
+		}
+		length, h, err := bin.LoadRef("foo")
+		if err != nil {
+			t.Fatalf("load ref error: %v", err)
+		}
+		if length != len(data) || h != hash {
+			t.Fatal("ref incorrect")
+		}
+	}
+	_, _, err := bin.LoadRef("bar")
+	if err == nil {
+		t.Fatal("loaded non exists ref")
+	}
+}
+
+func RunListTest(bin *Bin, t *testing.T) {
+	keys := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		data := genRandBytes(1024 * 64)
+		hash := hashBytes(data)
+		err := bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("save error: %v", err)
+		}
+		length, h := MapKey(bin.backend, len(data), hash)
+		keys[fmt.Sprintf("%d-%s", length, h)] = true
+		if i == 0 {
+			err = bin.Delete(length, h)
+			if err != nil {
+				t.Fatalf("delete error: %v", err)
+			}
+			exists, err := bin.Exists(len(data), hash)
+			if err != nil {
+				t.Fatalf("exists error: %v", err)
+			}
+			if exists {
+				t.Fatal("deleted data exists")
+			}
+			keys[fmt.Sprintf("%d-%s", length, h)] = false
+		}
+	}
+	entries, err := bin.List()
+	if err != nil {
+		t.Fatalf("list error: %v", err)
+	}
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Time.IsZero() {
+			t.Fatal("entry without time")
+		}
+		listed[fmt.Sprintf("%d-%s", entry.Length, entry.Hash)] = true
+	}
+	for key, exists := range keys {
+		if listed[key] != exists {
+			t.Fatalf("list incorrect for %s", key)
+		}
+	}
+}
+
+func RunRangeTest(bin *Bin, t *testing.T) {
+	data := genRandBytes(1024 * 64)
+	hash := hashBytes(data)
+	err := bin.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	length, h := MapKey(bin.backend, len(data), hash)
+	if length != len(data) {
+		t.Fatal("range read of mapped objects")
+	}
+	offset := len(data) / 3
+	size := len(data) / 2
+	reader, cb, err := NewRangeReader(bin.backend, length, h, offset, size)
+	if err != nil {
+		t.Fatalf("range read error: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(reader)
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		t.Fatalf("range read error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[offset:offset+size]) {
+		t.Fatal("range read data incorrect")
+	}
+}
+
+func RunContextTest(bin *Bin, t *testing.T) {
+	data := genRandBytes(1024 * 1024 * 4)
+	hash := hashBytes(data)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := bin.SaveContext(ctx, len(data), hash, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("saved with cancelled context")
+	}
+
+	// cancelled while writing
+	ctx, cancel = context.WithCancel(context.Background())
+	err = bin.SaveContext(ctx, len(data), hash, &cancelReader{bytes.NewReader(data), cancel})
+	if err == nil {
+		t.Fatal("save not cancelled")
+	}
+	exists, err := bin.Exists(len(data), hash)
+	if err != nil {
+		t.Fatalf("exists error: %v", err)
+	}
+	if exists {
+		t.Fatal("cancelled save committed")
+	}
+
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+	err = bin.FetchContext(ctx, len(data), hash, new(bytes.Buffer))
+	if err == nil {
+		t.Fatal("fetched with cancelled context")
+	}
+}
+
+// cancels after the first read
+type cancelReader struct {
+	reader *bytes.Reader
+	cancel func()
+}
+
+func (self *cancelReader) Read(p []byte) (int, error) {
+	defer self.cancel()
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	return self.reader.Read(p)
+}
+
+func RunExistsBatchTest(bin *Bin, t *testing.T) {
+	keys := make([]string, 0)
+	expected := make(map[string]bool)
+	for i := 0; i < 40; i++ {
+		data := append(genRandBytes(1024), byte(i))
+		hash := hashBytes(data)
+		key := fmt.Sprintf("%d-%s", len(data), hash)
+		keys = append(keys, key)
+		if i%3 == 0 {
+			continue
+		}
+		err := bin.Save(len(data), hash, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("save error: %v", err)
+		}
+		expected[key] = true
+	}
+	present, err := bin.ExistsBatch(keys)
+	if err != nil {
+		t.Fatalf("exists batch error: %v", err)
+	}
+	if len(present) != len(expected) {
+		t.Fatalf("%d keys present, expected %d", len(present), len(expected))
+	}
+	for key := range expected {
+		if !present[key] {
+			t.Fatalf("%s not present", key)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// an append-only record of completed keys, one per line, after a line naming
+// the backend generation they were recorded in
+type Journal struct {
+	sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	keys   map[string]bool
+	closed bool
+}
+
+const GENERATION_PREFIX = "generation "
+
+// keys recorded in another generation are dropped, the backend may have deleted them
+func Open(path string, generation string) (*Journal, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New(fmt.Sprintf("read journal: %v", err))
+	}
+	keys := make(map[string]bool)
+	// a line without newline is an interrupted write
+	end := bytes.LastIndexByte(content, '\n') + 1
+	lines := bytes.Split(content[:end], []byte("\n"))
+	recorded := ""
+	if bytes.HasPrefix(lines[0], []byte(GENERATION_PREFIX)) {
+		recorded = string(lines[0][len(GENERATION_PREFIX):])
+		lines = lines[1:]
+	}
+	if recorded != generation {
+		lines = nil
+		end = 0
+	}
+	for _, line := range lines {
+		if len(line) > 0 {
+			keys[string(line)] = true
+		}
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("open journal: %v", err))
+	}
+	err = file.Truncate(int64(end))
+	if err == nil {
+		_, err = file.Seek(int64(end), 0)
+	}
+	writer := bufio.NewWriter(file)
+	if err == nil && end == 0 && generation != "" {
+		_, err = writer.WriteString(GENERATION_PREFIX + generation + "\n")
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Journal{
+		file:   file,
+		writer: writer,
+		keys:   keys,
+	}, nil
+}
+
+func (self *Journal) Has(key string) bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.keys[key]
+}
+
+func (self *Journal) Len() int {
+	self.Lock()
+	defer self.Unlock()
+	return len(self.keys)
+}
+
+// buffered until the next Sync
+func (self *Journal) Add(key string) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.keys[key] {
+		return nil
+	}
+	self.keys[key] = true
+	_, err := self.writer.WriteString(key + "\n")
+	return err
+}
+
+func (self *Journal) Sync() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.closed {
+		return nil
+	}
+	err := self.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return self.file.Sync()
+}
+
+func (self *Journal) Close() error {
+	err := self.Sync()
+	self.Lock()
+	defer self.Unlock()
+	self.closed = true
+	if err != nil {
+		self.file.Close()
+		return err
+	}
+	return self.file.Close()
+}
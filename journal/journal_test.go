@@ -0,0 +1,86 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	journal, err := Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"1-aa", "2-bb", "1-aa"} {
+		err = journal.Add(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !journal.Has("1-aa") || journal.Has("3-cc") || journal.Len() != 2 {
+		t.Fatal("journal keys incorrect")
+	}
+	err = journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("3-c")
+	f.Close()
+
+	journal, err = Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal.Len() != 2 || journal.Has("3-c") {
+		t.Fatal("partial line loaded")
+	}
+	journal.Add("4-dd")
+	journal.Close()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "1-aa\n2-bb\n4-dd\n" {
+		t.Fatalf("bad journal content %q", content)
+	}
+
+	// keys of another generation are dropped
+	journal, err = Open(path, "g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal.Len() != 0 {
+		t.Fatal("keys of another generation loaded")
+	}
+	journal.Add("5-ee")
+	journal.Close()
+	journal, err = Open(path, "g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal.Len() != 1 || !journal.Has("5-ee") {
+		t.Fatal("keys of the same generation not loaded")
+	}
+	journal.Close()
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "generation g1\n5-ee\n" {
+		t.Fatalf("bad journal content %q", content)
+	}
+}
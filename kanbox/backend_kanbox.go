@@ -2,14 +2,17 @@ package kanbox
 
 import (
 	"../hashbin"
+	"../utils"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net"
 	"net/http"
 	neturl "net/url"
+	pathpkg "path"
 	"time"
 
 	"code.google.com/p/goauth2/oauth"
@@ -53,6 +56,10 @@ func New(dir string, token *oauth.Token) (*KanBox, error) {
 }
 
 func (self *KanBox) Exists(length int, hash string) (bool, error) {
+	return self.ExistsContext(context.Background(), length, hash)
+}
+
+func (self *KanBox) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
 	key := fmt.Sprintf("%d-%s", length, hash)
 	if _, ok := self.keys[key]; ok {
 		return true, nil
@@ -62,9 +69,17 @@ func (self *KanBox) Exists(length int, hash string) (bool, error) {
 }
 
 func (self *KanBox) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *KanBox) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
 	path := neturl.QueryEscape(fmt.Sprintf("/%s/%s/%d-%s", self.dir, hash[:2], length, hash))
 	url := fmt.Sprintf("https://api.kanbox.com/0/download?bearer_token=%s&path=%s", self.token.AccessToken, path)
-	resp, err := self.client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := self.client.Do(req)
 	if err != nil {
 		return nil, nil, errors.New(fmt.Sprintf("get error, %s", url))
 	}
@@ -86,12 +101,15 @@ func (self *KanBox) NewReader(length int, hash string) (io.Reader, hashbin.Callb
 }
 
 func (self *KanBox) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
-	buf := new(bytes.Buffer)
-	return buf, func(err error) error {
-		if err != nil {
-			return err
-		}
-		err = self.upload(fmt.Sprintf("%s/%d-%s", hash[:2], length, hash), buf.Bytes(), length)
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *KanBox) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	writer, cb := hashbin.NewPipeWriter(length, func(data io.Reader) error {
+		return self.upload(ctx, fmt.Sprintf("%s/%d-%s", hash[:2], length, hash), data, length)
+	})
+	return writer, func(err error) error {
+		err = cb(err)
 		if err != nil {
 			return err
 		}
@@ -100,23 +118,25 @@ func (self *KanBox) NewWriter(length int, hash string) (io.Writer, hashbin.Callb
 	}, nil
 }
 
-func (self *KanBox) upload(path string, data []byte, length int) error {
+func (self *KanBox) upload(ctx context.Context, path string, data io.Reader, length int) error {
 	url := fmt.Sprintf("https://api-upload.kanbox.com/0/upload?bearer_token=%s", self.token.AccessToken)
 	url += "&path=" + neturl.QueryEscape(fmt.Sprintf("/%s/%s", self.dir, path))
 	fmt.Printf("%s\n", url)
 
-	buf := new(bytes.Buffer)
-	form := multipart.NewWriter(buf)
-	field, _ := form.CreateFormFile("file", "file")
-	field.Write(data)
-	form.Close()
-	resp, err := self.client.Post(url, form.FormDataContentType(), buf)
+	body, contentType, size := utils.MultipartBody("file", data, length)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := self.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	buf.Reset()
+	buf := new(bytes.Buffer)
 	_, err = io.Copy(buf, resp.Body)
 	if err != nil {
 		return errors.New("response body read error")
@@ -146,3 +166,76 @@ func (self *KanBox) Mkdir(path string) error {
 
 	return nil
 }
+
+func (self *KanBox) List() ([]hashbin.Entry, error) {
+	entries := make([]hashbin.Entry, 0)
+	chars := "0123456789abcdef"
+	for _, a := range chars {
+		for _, b := range chars {
+			path := neturl.QueryEscape(fmt.Sprintf("/%s/%c%c", self.dir, a, b))
+			url := fmt.Sprintf("https://api.kanbox.com/0/list?bearer_token=%s&path=%s", self.token.AccessToken, path)
+			resp, err := self.client.Get(url)
+			if err != nil {
+				return nil, err
+			}
+			buf := new(bytes.Buffer)
+			_, err = io.Copy(buf, resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, errors.New("response body read error")
+			}
+			if resp.StatusCode != http.StatusOK {
+				return nil, errors.New(fmt.Sprintf("list error %d %s", resp.StatusCode, buf.Bytes()))
+			}
+			var result struct {
+				Status   string
+				Contents []struct {
+					FullPath         string
+					ModificationDate string
+					IsFolder         bool
+				}
+			}
+			err = json.NewDecoder(buf).Decode(&result)
+			if err != nil {
+				return nil, errors.New("return json decode error")
+			}
+			for _, content := range result.Contents {
+				if content.IsFolder {
+					continue
+				}
+				length, hash, err := hashbin.ParseKey(pathpkg.Base(content.FullPath))
+				if err != nil {
+					continue
+				}
+				// unparsable time is left zero, which gc treats as recent
+				t, _ := time.Parse(time.RFC3339, content.ModificationDate)
+				entries = append(entries, hashbin.Entry{
+					Length: length,
+					Hash:   hash,
+					Time:   t,
+				})
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (self *KanBox) Delete(length int, hash string) error {
+	path := neturl.QueryEscape(fmt.Sprintf("/%s/%s/%d-%s", self.dir, hash[:2], length, hash))
+	url := fmt.Sprintf("https://api.kanbox.com/0/delete?bearer_token=%s&path=%s", self.token.AccessToken, path)
+	resp, err := self.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, resp.Body)
+	if err != nil {
+		return errors.New("response body read error")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("delete error %d %s", resp.StatusCode, buf.Bytes()))
+	}
+	delete(self.keys, fmt.Sprintf("%d-%s", length, hash))
+	return nil
+}
@@ -0,0 +1,17 @@
+package kanbox
+
+import (
+	"../hashbin"
+	"code.google.com/p/goauth2/oauth"
+)
+
+func init() {
+	hashbin.RegisterFactory("kanbox", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		var token oauth.Token
+		err := env.Credential(spec, "token", "kanbox_token", &token)
+		if err != nil {
+			return nil, err
+		}
+		return New(spec.Param("dir", "hashstorage"), &token)
+	})
+}
@@ -9,7 +9,8 @@ import (
 	"code.google.com/p/goauth2/oauth"
 )
 
-func Setup(dir string, register *register.Register) error {
+// the token is saved under the given register entry
+func Setup(dir string, register *register.Register, tokenKey string) error {
 	var key, secret string
 	fmt.Printf("enter key:\n")
 	n, err := fmt.Scanf("%s\n", &key)
@@ -41,7 +42,7 @@ func Setup(dir string, register *register.Register) error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = register.Set("kanbox_token", token)
+	err = register.Set(tokenKey, token)
 	if err != nil {
 		return err
 	}
@@ -6,9 +6,21 @@ import (
 	"log"
 	"os"
 	"sort"
+	"time"
 )
 
 func (self *App) runList() {
+	b, err := self.getBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(self.snapshotSet.Snapshots) == 0 {
+		err = self.pullSnapshots(b)
+		if err != nil {
+			fmt.Printf("no snapshot: %v\n", err)
+			os.Exit(0)
+		}
+	}
 	if len(self.snapshotSet.Snapshots) == 0 {
 		fmt.Printf("no snapshot\n")
 		os.Exit(0)
@@ -21,7 +33,13 @@ func (self *App) runList() {
 	}
 	sort.Strings(paths)
 
-	b, err := self.getBaiduBackend()
+	keys := make([]string, 0)
+	for _, path := range paths {
+		for _, chunk := range lastSnapshot.Files[path].Chunks {
+			keys = append(keys, fmt.Sprintf("%d-%s", chunk.Length, chunk.Hash))
+		}
+	}
+	present, err := b.ExistsBatch(keys)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -31,11 +49,7 @@ func (self *App) runList() {
 		file := lastSnapshot.Files[path]
 		complete := true
 		for _, chunk := range file.Chunks {
-			e, err := b.Exists(int(chunk.Length), chunk.Hash)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if !e {
+			if !present[fmt.Sprintf("%d-%s", chunk.Length, chunk.Hash)] {
 				complete = false
 			}
 		}
@@ -48,3 +62,14 @@ func (self *App) runList() {
 
 	fmt.Printf("%s\n", utils.FormatSize(int(totalSize)))
 }
+
+func (self *App) runSnapshots() {
+	for i, snapshot := range self.snapshotSet.Snapshots {
+		var size int64
+		for _, file := range snapshot.Files {
+			size += file.Size
+		}
+		fmt.Printf("%d\t%s\t%d files\t%s\t%s\n", i, snapshot.Time.Format(time.RFC3339),
+			len(snapshot.Files), utils.FormatSize(int(size)), snapshot.Tag)
+	}
+}
@@ -0,0 +1,148 @@
+package local
+
+import (
+	"../hashbin"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type Local struct {
+	dir string
+}
+
+func New(dir string) (*Local, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(fmt.Sprintf("not a directory: %s", dir))
+	}
+	return &Local{
+		dir: dir,
+	}, nil
+}
+
+func (self *Local) path(length int, hash string) string {
+	return filepath.Join(self.dir, hash[:2], fmt.Sprintf("%d-%s", length, hash))
+}
+
+func (self *Local) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	path := self.path(length, hash)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func(err error) error {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		err = f.Sync()
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		err = os.Rename(f.Name(), path)
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		return nil
+	}, nil
+}
+
+func (self *Local) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	f, err := os.Open(self.path(length, hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func(err error) error {
+		f.Close()
+		return err
+	}, nil
+}
+
+func (self *Local) NewRangeReader(length int, hash string, offset, size int) (io.Reader, hashbin.Callback, error) {
+	f, err := os.Open(self.path(length, hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = f.Seek(int64(offset), 0)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return io.LimitReader(f, int64(size)), func(err error) error {
+		f.Close()
+		return err
+	}, nil
+}
+
+func (self *Local) Exists(length int, hash string) (bool, error) {
+	_, err := os.Stat(self.path(length, hash))
+	if err == nil {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// stats are cheap, so more run at a time than for remote backends
+const STAT_WORKERS = 64
+
+func (self *Local) ExistsBatch(ctx context.Context, keys []string) (map[string]bool, error) {
+	return hashbin.ExistsConcurrently(ctx, keys, STAT_WORKERS, func(ctx context.Context, length int, hash string) (bool, error) {
+		return self.Exists(length, hash)
+	})
+}
+
+func (self *Local) List() ([]hashbin.Entry, error) {
+	entries := make([]hashbin.Entry, 0)
+	dirs, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(self.dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			length, hash, err := hashbin.ParseKey(info.Name())
+			if err != nil { // temp files
+				continue
+			}
+			entries = append(entries, hashbin.Entry{
+				Length: length,
+				Hash:   hash,
+				Time:   info.ModTime(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+func (self *Local) Delete(length int, hash string) error {
+	return os.Remove(self.path(length, hash))
+}
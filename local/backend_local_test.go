@@ -0,0 +1,35 @@
+package local
+
+import (
+	"../hashbin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(local)
+	hashbin.RunTest(bin, t)
+	hashbin.RunRefTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunRangeTest(bin, t)
+	hashbin.RunExistsBatchTest(bin, t)
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			t.Fatalf("temp file not removed: %s", path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,16 @@
+package local
+
+import (
+	"../hashbin"
+	"errors"
+)
+
+func init() {
+	hashbin.RegisterFactory("local", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		dir := spec.Param("dir", "")
+		if dir == "" {
+			return nil, errors.New("dir required")
+		}
+		return New(dir)
+	})
+}
@@ -1,16 +1,30 @@
 package main
 
 import (
+	_ "./compression"
+	_ "./crypt"
+	_ "./erasure"
+	_ "./kanbox"
+	_ "./local"
+	_ "./pack"
+	_ "./ratelimit"
 	"./register"
+	_ "./s3"
 	"./snapshot"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 type App struct {
@@ -22,6 +36,9 @@ type App struct {
 	escapedPath      string
 	snapshotSet      *snapshot.SnapshotSet
 	snapshotFilePath string
+	config           *Config
+	selectedBackend  string
+	ctx              context.Context
 }
 
 func main() {
@@ -33,6 +50,7 @@ func main() {
 	go http.ListenAndServe("0.0.0.0:55555", nil)
 
 	app := new(App)
+	app.ctx = context.Background()
 
 	user, err := user.Current()
 	if err != nil {
@@ -57,7 +75,9 @@ func main() {
 	var path string
 	for i := 2; i < len(os.Args); i++ {
 		arg := os.Args[i]
-		if arg[0] == '-' {
+		if strings.HasPrefix(arg, "--backend=") {
+			app.selectedBackend = strings.TrimPrefix(arg, "--backend=")
+		} else if _, err := strconv.Atoi(arg); err != nil && arg[0] == '-' { // negative numbers are snapshot selectors
 			app.flags = append(app.flags, arg)
 		} else {
 			if path == "" {
@@ -94,8 +114,10 @@ func main() {
 
 	switch os.Args[1] {
 	case "snapshot":
+		app.cancelOnInterrupt()
 		app.runSnapshot()
 	case "upload":
+		app.cancelOnInterrupt()
 		app.runUpload()
 	case "setup":
 		app.runSetup()
@@ -103,7 +125,76 @@ func main() {
 		app.runUpdate()
 	case "list":
 		app.runList()
+	case "restore":
+		app.cancelOnInterrupt()
+		app.runRestore()
+	case "pull":
+		app.runPull()
+	case "snapshots":
+		app.runSnapshots()
+	case "rebuild-keys":
+		app.runRebuildKeys()
+	case "gc":
+		app.runGC()
+	case "forget":
+		app.runForget()
+	case "diff":
+		app.runDiff()
 	default:
 		log.Fatalf("unknown command %s", os.Args[1])
 	}
 }
+
+// the first interrupt cancels self.ctx so the command can stop cleanly,
+// the second one exits at once
+func (self *App) cancelOnInterrupt() {
+	ctx, cancel := context.WithCancel(context.Background())
+	self.ctx = ctx
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		fmt.Printf("interrupted, stopping\n")
+		cancel()
+		<-c
+		fmt.Printf("interrupted again, exiting\n")
+		os.Exit(1)
+	}()
+}
+
+func compilePatterns(args []string) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0)
+	for _, arg := range args {
+		patterns = append(patterns, regexp.MustCompilePOSIX("^"+arg))
+	}
+	return patterns
+}
+
+func (self *App) relativePath(path string) string {
+	relativePath := strings.TrimPrefix(path, self.path)
+	return strings.TrimPrefix(relativePath, "/")
+}
+
+func (self *App) matchPath(patterns []*regexp.Regexp, path string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	relativePath := self.relativePath(path)
+	for _, p := range patterns {
+		if p.MatchString(relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *App) selectSnapshot(selector string) (*snapshot.Snapshot, error) {
+	if selector == "" {
+		selector = "-1"
+	}
+	index, err := self.snapshotSet.Select(selector)
+	if err != nil {
+		return nil, err
+	}
+	return self.snapshotSet.Snapshots[index], nil
+}
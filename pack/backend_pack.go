@@ -0,0 +1,699 @@
+package pack
+
+import (
+	"../hashbin"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_THRESHOLD = 4 * 1024 * 1024
+	DEFAULT_PACK_SIZE = 32 * 1024 * 1024
+	// a longer chain of index segments is compacted into one
+	MAX_SEGMENTS = 32
+)
+
+type Location struct {
+	PackLength int
+	PackHash   string
+	Offset     int
+}
+
+// a change to the index, the latest one of a key wins
+type event struct {
+	Location
+	Time    time.Time
+	Deleted bool
+}
+
+// index changes saved by one flush, linked to the previous segment of the same writer
+type segment struct {
+	Prev    string
+	Count   int // segments in the chain
+	Entries map[string]event
+}
+
+// a pack being saved, still readable
+type sealed struct {
+	data    []byte
+	offsets map[string]int
+}
+
+// small objects are appended to a pack buffer, saved as one object when full or flushed.
+// each writer, usually a machine, appends the index changes of a flush as a segment
+// behind its own ref, and the writers are listed behind a shared ref.
+// the index is merged from the chains of all writers on load
+type Pack struct {
+	backend    hashbin.Backend
+	bin        *hashbin.Bin
+	name       string
+	writer     string
+	writersRef string
+	threshold  int
+	packSize   int
+
+	lock      sync.Mutex
+	index     map[string]Location
+	packs     map[string]int // live objects in each pack
+	buffer    *bytes.Buffer
+	offsets   map[string]int // of objects in buffer
+	uploading []*sealed
+	listed    map[string]string // stored keys returned by List to keys
+
+	writers    []string
+	registered bool
+	own        map[string]event // saved changes of this writer, for compaction
+	pending    map[string]event // changes not saved yet
+	head       string           // the last segment of this writer
+	chain      int              // segments in the chain of this writer
+	hidden     map[string]bool  // index objects, not listed
+
+	saveLock sync.Mutex
+
+	cacheLock sync.Mutex
+	cacheKey  string
+	cache     []byte
+}
+
+// writers sharing a backend must have distinct names
+func New(backend hashbin.Backend, name, writer string, threshold, packSize int) (*Pack, error) {
+	if threshold <= 0 || packSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid threshold %d or pack size %d", threshold, packSize))
+	}
+	if writer == "" {
+		return nil, errors.New("empty writer name")
+	}
+	self := &Pack{
+		backend:    backend,
+		bin:        hashbin.New(backend),
+		name:       name,
+		writer:     writer,
+		writersRef: "pack writers " + name,
+		threshold:  threshold,
+		packSize:   packSize,
+		buffer:     new(bytes.Buffer),
+		offsets:    make(map[string]int),
+		listed:     make(map[string]string),
+		pending:    make(map[string]event),
+	}
+	err := self.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *Pack) chainRef(writer string) string {
+	return "pack index " + self.name + " " + writer
+}
+
+func (self *Pack) fetchGob(length int, hash string, target interface{}) error {
+	buf := new(bytes.Buffer)
+	err := self.bin.Fetch(length, hash, buf)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(buf).Decode(target)
+}
+
+// the writers list and the object holding it, empty without one
+func (self *Pack) loadWriters() ([]string, string, error) {
+	exists, err := self.bin.RefExists(self.writersRef)
+	if err != nil || !exists {
+		return nil, "", err
+	}
+	length, hash, err := self.bin.LoadRef(self.writersRef)
+	if err != nil {
+		return nil, "", err
+	}
+	var writers []string
+	err = self.fetchGob(length, hash, &writers)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("load pack writers: %v", err))
+	}
+	return writers, fmt.Sprintf("%d-%s", length, hash), nil
+}
+
+// changes in the chain of writer, the keys of its segments and the head segment
+func (self *Pack) loadChain(writer string) (map[string]event, []string, error) {
+	events := make(map[string]event)
+	keys := make([]string, 0)
+	exists, err := self.bin.RefExists(self.chainRef(writer))
+	if err != nil || !exists {
+		return events, keys, err
+	}
+	length, hash, err := self.bin.LoadRef(self.chainRef(writer))
+	if err != nil {
+		return nil, nil, err
+	}
+	key := fmt.Sprintf("%d-%s", length, hash)
+	// from the newest segment
+	for key != "" {
+		keys = append(keys, key)
+		length, hash, err := hashbin.ParseKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		var seg segment
+		err = self.fetchGob(length, hash, &seg)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("load pack index segment of %s: %v", writer, err))
+		}
+		for k, e := range seg.Entries {
+			if _, ok := events[k]; !ok {
+				events[k] = e
+			}
+		}
+		key = seg.Prev
+	}
+	return events, keys, nil
+}
+
+// merge the chains of all writers, replacing the index.
+// changes not saved yet are kept
+func (self *Pack) loadIndex() error {
+	// a segment saved meanwhile would be missed
+	self.saveLock.Lock()
+	defer self.saveLock.Unlock()
+	writers, writersKey, err := self.loadWriters()
+	if err != nil {
+		return err
+	}
+	hidden := make(map[string]bool)
+	if writersKey != "" {
+		hidden[writersKey] = true
+	}
+	merged := make(map[string]event)
+	var own map[string]event
+	var ownKeys []string
+	for _, writer := range writers {
+		events, keys, err := self.loadChain(writer)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			hidden[key] = true
+		}
+		if writer == self.writer {
+			own = events
+			ownKeys = keys
+		}
+		for k, e := range events {
+			if m, ok := merged[k]; !ok || e.Time.After(m.Time) {
+				merged[k] = e
+			}
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for k, e := range self.pending {
+		merged[k] = e
+	}
+	self.index = make(map[string]Location)
+	self.packs = make(map[string]int)
+	for k, e := range merged {
+		if e.Deleted {
+			continue
+		}
+		self.index[k] = e.Location
+		self.packs[packKey(e.Location)]++
+	}
+	self.writers = writers
+	for _, writer := range writers {
+		if writer == self.writer {
+			self.registered = true
+		}
+	}
+	self.own = own
+	if self.own == nil {
+		self.own = make(map[string]event)
+	}
+	self.head = ""
+	if len(ownKeys) > 0 {
+		self.head = ownKeys[0]
+	}
+	self.chain = len(ownKeys)
+	self.hidden = hidden
+	return nil
+}
+
+func packKey(loc Location) string {
+	return fmt.Sprintf("%d-%s", loc.PackLength, loc.PackHash)
+}
+
+func save(backend hashbin.Backend, length int, hash string, data []byte) error {
+	writer, cb, err := backend.NewWriter(length, hash)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if cb != nil {
+		err = cb(err)
+	}
+	return err
+}
+
+func (self *Pack) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+// a pack saved when adding a small object is shared, and not cancelled with ctx
+func (self *Pack) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	// refs are mutable
+	if length >= self.threshold || length == hashbin.REF_LENGTH {
+		return hashbin.WithContext(self.backend).NewWriterContext(ctx, length, hash)
+	}
+	buf := new(bytes.Buffer)
+	return buf, func(err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return hashbin.Permanent(ctx.Err())
+		}
+		return self.add(fmt.Sprintf("%d-%s", length, hash), buf.Bytes())
+	}, nil
+}
+
+// with lock held
+func (self *Pack) has(key string) bool {
+	if _, ok := self.index[key]; ok {
+		return true
+	}
+	if _, ok := self.offsets[key]; ok {
+		return true
+	}
+	for _, s := range self.uploading {
+		if _, ok := s.offsets[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Pack) add(key string, data []byte) error {
+	self.lock.Lock()
+	if self.has(key) {
+		self.lock.Unlock()
+		return nil
+	}
+	self.offsets[key] = self.buffer.Len()
+	self.buffer.Write(data)
+	if self.buffer.Len() < self.packSize {
+		self.lock.Unlock()
+		return nil
+	}
+	s := self.seal()
+	self.lock.Unlock()
+	return self.upload(s)
+}
+
+// with lock held
+func (self *Pack) seal() *sealed {
+	if len(self.offsets) == 0 {
+		return nil
+	}
+	s := &sealed{
+		data:    self.buffer.Bytes(),
+		offsets: self.offsets,
+	}
+	self.uploading = append(self.uploading, s)
+	self.buffer = new(bytes.Buffer)
+	self.offsets = make(map[string]int)
+	return s
+}
+
+func (self *Pack) upload(s *sealed) error {
+	length := len(s.data)
+	hash := fmt.Sprintf("%x", sha512.Sum512(s.data))
+	err := save(self.backend, length, hash, s.data)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, u := range self.uploading {
+		if u == s {
+			self.uploading = append(self.uploading[:i], self.uploading[i+1:]...)
+			break
+		}
+	}
+	if err != nil {
+		// back to the buffer for the next pack
+		for key, offset := range s.offsets {
+			l, _, _ := hashbin.ParseKey(key)
+			self.offsets[key] = self.buffer.Len()
+			self.buffer.Write(s.data[offset : offset+l])
+		}
+		return errors.New(fmt.Sprintf("save pack: %v", err))
+	}
+	now := time.Now()
+	for key, offset := range s.offsets {
+		loc := Location{
+			PackLength: length,
+			PackHash:   hash,
+			Offset:     offset,
+		}
+		self.index[key] = loc
+		self.packs[packKey(loc)]++
+		self.pending[key] = event{
+			Location: loc,
+			Time:     now,
+		}
+	}
+	return nil
+}
+
+func (self *Pack) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *Pack) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	key := fmt.Sprintf("%d-%s", length, hash)
+	self.lock.Lock()
+	if offset, ok := self.offsets[key]; ok {
+		data := make([]byte, length)
+		copy(data, self.buffer.Bytes()[offset:])
+		self.lock.Unlock()
+		return bytes.NewReader(data), nil, nil
+	}
+	for _, s := range self.uploading {
+		if offset, ok := s.offsets[key]; ok {
+			self.lock.Unlock()
+			return bytes.NewReader(s.data[offset : offset+length]), nil, nil
+		}
+	}
+	loc, ok := self.index[key]
+	self.lock.Unlock()
+	if !ok {
+		return hashbin.WithContext(self.backend).NewReaderContext(ctx, length, hash)
+	}
+
+	reader, cb, err := hashbin.NewRangeReader(self.backend, loc.PackLength, loc.PackHash, loc.Offset, length)
+	if err != hashbin.ErrNotSupported {
+		return reader, cb, err
+	}
+	// keep the last fetched pack, since objects are usually fetched in the order they are saved
+	self.cacheLock.Lock()
+	defer self.cacheLock.Unlock()
+	if self.cacheKey != packKey(loc) {
+		data, err := self.fetchPack(ctx, loc)
+		if err != nil {
+			return nil, nil, err
+		}
+		self.cacheKey = packKey(loc)
+		self.cache = data
+	}
+	return bytes.NewReader(self.cache[loc.Offset : loc.Offset+length]), nil, nil
+}
+
+func (self *Pack) fetchPack(ctx context.Context, loc Location) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := self.bin.FetchContext(ctx, loc.PackLength, loc.PackHash, buf)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("fetch pack: %v", err))
+	}
+	return buf.Bytes(), nil
+}
+
+func (self *Pack) Exists(length int, hash string) (bool, error) {
+	return self.ExistsContext(context.Background(), length, hash)
+}
+
+func (self *Pack) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	self.lock.Lock()
+	has := self.has(fmt.Sprintf("%d-%s", length, hash))
+	self.lock.Unlock()
+	if has {
+		return true, nil
+	}
+	return hashbin.WithContext(self.backend).ExistsContext(ctx, length, hash)
+}
+
+func (self *Pack) saveBuffer() error {
+	self.lock.Lock()
+	s := self.seal()
+	self.lock.Unlock()
+	if s == nil {
+		return nil
+	}
+	return self.upload(s)
+}
+
+// save the buffered pack and the index
+func (self *Pack) Flush() error {
+	err := self.saveBuffer()
+	if err != nil {
+		return err
+	}
+	err = self.saveIndex()
+	if err != nil {
+		return err
+	}
+	return hashbin.Flush(self.backend)
+}
+
+// saves pending changes as a new segment of this writer
+func (self *Pack) saveIndex() error {
+	self.saveLock.Lock()
+	defer self.saveLock.Unlock()
+	self.lock.Lock()
+	if len(self.pending) == 0 {
+		self.lock.Unlock()
+		return nil
+	}
+	seg := &segment{
+		Prev:    self.head,
+		Count:   self.chain + 1,
+		Entries: make(map[string]event),
+	}
+	if seg.Count > MAX_SEGMENTS {
+		seg.Prev = ""
+		seg.Count = 1
+		for k, e := range self.own {
+			seg.Entries[k] = e
+		}
+	}
+	saving := make(map[string]event)
+	for k, e := range self.pending {
+		seg.Entries[k] = e
+		saving[k] = e
+	}
+	registered := self.registered
+	self.lock.Unlock()
+
+	key, err := self.saveSegment(seg, registered)
+	if err != nil {
+		return errors.New(fmt.Sprintf("save pack index: %v", err))
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.registered = true
+	if seg.Prev == "" {
+		self.own = make(map[string]event)
+	}
+	for k, e := range saving {
+		self.own[k] = e
+		// unless changed again meanwhile
+		if self.pending[k] == e {
+			delete(self.pending, k)
+		}
+	}
+	self.head = key
+	self.chain = seg.Count
+	self.hidden[key] = true
+	return nil
+}
+
+func (self *Pack) saveSegment(seg *segment, registered bool) (string, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(seg)
+	if err != nil {
+		return "", err
+	}
+	length := buf.Len()
+	hash := fmt.Sprintf("%x", sha512.Sum512(buf.Bytes()))
+	err = self.bin.Save(length, hash, buf)
+	if err != nil {
+		return "", err
+	}
+	if !registered {
+		err = self.register()
+		if err != nil {
+			return "", err
+		}
+	}
+	// the ref must not point to unsaved objects
+	err = hashbin.Flush(self.backend)
+	if err != nil {
+		return "", err
+	}
+	err = self.bin.SaveRef(self.chainRef(self.writer), length, hash)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", length, hash), nil
+}
+
+// add this writer to the writers list. concurrent registrations may overwrite
+// each other, so the list is read again to check
+func (self *Pack) register() error {
+	writers, _, err := self.loadWriters()
+	if err != nil {
+		return err
+	}
+	for _, writer := range writers {
+		if writer == self.writer {
+			return nil
+		}
+	}
+	writers = append(writers, self.writer)
+	sort.Strings(writers)
+	buf := new(bytes.Buffer)
+	err = gob.NewEncoder(buf).Encode(writers)
+	if err != nil {
+		return err
+	}
+	length := buf.Len()
+	hash := fmt.Sprintf("%x", sha512.Sum512(buf.Bytes()))
+	err = self.bin.Save(length, hash, buf)
+	if err != nil {
+		return err
+	}
+	err = hashbin.Flush(self.backend)
+	if err != nil {
+		return err
+	}
+	err = self.bin.SaveRef(self.writersRef, length, hash)
+	if err != nil {
+		return err
+	}
+	writers, key, err := self.loadWriters()
+	if err != nil {
+		return err
+	}
+	for _, writer := range writers {
+		if writer == self.writer {
+			self.lock.Lock()
+			self.writers = writers
+			self.hidden[key] = true
+			self.lock.Unlock()
+			return nil
+		}
+	}
+	return errors.New("pack writer not registered, retry")
+}
+
+func (self *Pack) MapKey(length int, hash string) (int, string) {
+	return hashbin.MapKey(self.backend, length, hash)
+}
+
+func (self *Pack) mappedKey(key string) string {
+	length, hash, _ := hashbin.ParseKey(key)
+	length, hash = hashbin.MapKey(self.backend, length, hash)
+	return fmt.Sprintf("%d-%s", length, hash)
+}
+
+// packed objects are listed with the time of their pack, packs and the index are not listed.
+// the index is loaded again, so objects packed by other writers are listed
+func (self *Pack) List() ([]hashbin.Entry, error) {
+	err := self.Flush()
+	if err != nil {
+		return nil, err
+	}
+	err = self.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := hashbin.List(self.backend)
+	if err != nil {
+		return nil, err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	hidden := make(map[string]bool)
+	for key := range self.packs {
+		hidden[self.mappedKey(key)] = true
+	}
+	for key := range self.hidden {
+		hidden[self.mappedKey(key)] = true
+	}
+	refs := []string{self.writersRef}
+	for _, writer := range self.writers {
+		refs = append(refs, self.chainRef(writer))
+	}
+	for _, ref := range refs {
+		length, hash := hashbin.RefKey(ref)
+		hidden[self.mappedKey(fmt.Sprintf("%d-%s", length, hash))] = true
+	}
+
+	entries := make([]hashbin.Entry, 0, len(stored)+len(self.index))
+	packTimes := make(map[string]hashbin.Entry)
+	for _, entry := range stored {
+		key := fmt.Sprintf("%d-%s", entry.Length, entry.Hash)
+		if hidden[key] {
+			packTimes[key] = entry
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	self.listed = make(map[string]string)
+	for key, loc := range self.index {
+		mapped := self.mappedKey(key)
+		length, hash, _ := hashbin.ParseKey(mapped)
+		self.listed[mapped] = key
+		entries = append(entries, hashbin.Entry{
+			Length: length,
+			Hash:   hash,
+			Time:   packTimes[self.mappedKey(packKey(loc))].Time,
+		})
+	}
+	return entries, nil
+}
+
+// packs are deleted when all objects in them are deleted
+// the index is saved on Flush
+func (self *Pack) Delete(length int, hash string) error {
+	err := self.saveBuffer()
+	if err != nil {
+		return err
+	}
+	stored := fmt.Sprintf("%d-%s", length, hash)
+	self.lock.Lock()
+	key, ok := self.listed[stored]
+	if !ok && self.mappedKey(stored) == stored {
+		key = stored
+	}
+	loc, ok := self.index[key]
+	if !ok {
+		self.lock.Unlock()
+		return hashbin.Delete(self.backend, length, hash)
+	}
+	delete(self.index, key)
+	delete(self.listed, stored)
+	self.pending[key] = event{
+		Time:    time.Now(),
+		Deleted: true,
+	}
+	self.packs[packKey(loc)]--
+	empty := self.packs[packKey(loc)] == 0
+	if empty {
+		delete(self.packs, packKey(loc))
+	}
+	self.lock.Unlock()
+	if !empty {
+		return nil
+	}
+	length, hash = hashbin.MapKey(self.backend, loc.PackLength, loc.PackHash)
+	return hashbin.Delete(self.backend, length, hash)
+}
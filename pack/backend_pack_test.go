@@ -0,0 +1,203 @@
+package pack
+
+import (
+	"../hashbin"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// hides the range reading of the mem backend
+type noRange struct {
+	*hashbin.Membin
+}
+
+func (self *noRange) NewRangeReader(length int, hash string, offset, size int) (io.Reader, hashbin.Callback, error) {
+	return nil, nil, hashbin.ErrNotSupported
+}
+
+func randData(size int) ([]byte, string) {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data, fmt.Sprintf("%x", sha512.Sum512(data))
+}
+
+func TestPackBackend(t *testing.T) {
+	for _, newBackend := range []func() hashbin.Backend{
+		func() hashbin.Backend { return hashbin.NewMembin() },
+		func() hashbin.Backend { return &noRange{hashbin.NewMembin()} },
+	} {
+		pack, err := New(newBackend(), "test", "a", 1024*1024, 256*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin := hashbin.New(pack)
+		hashbin.RunTest(bin, t)
+		hashbin.RunRefTest(bin, t)
+		hashbin.RunListTest(bin, t)
+		hashbin.RunContextTest(bin, t)
+
+		// small objects, without the objects of the tests above in the packs
+		backend := newBackend()
+		pack, err = New(backend, "test", "a", 1024*1024, 256*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin = hashbin.New(pack)
+		saved := make(map[string][]byte)
+		for i := 0; i < 50; i++ {
+			data, hash := randData(16 * 1024)
+			err = bin.Save(len(data), hash, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved[hash] = data
+		}
+		for hash, data := range saved {
+			buf := new(bytes.Buffer)
+			err = bin.Fetch(len(data), hash, buf)
+			if err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("fetch before flush: %v", err)
+			}
+		}
+		err = bin.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := hashbin.List(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) > 20 {
+			t.Fatalf("%d objects stored, not packed", len(entries))
+		}
+
+		// reopen with the saved index
+		pack, err = New(backend, "test", "a", 1024*1024, 256*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin = hashbin.New(pack)
+		for hash, data := range saved {
+			exists, err := bin.Exists(len(data), hash)
+			if err != nil || !exists {
+				t.Fatal("packed object not exists")
+			}
+			buf := new(bytes.Buffer)
+			err = bin.Fetch(len(data), hash, buf)
+			if err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("fetch from pack: %v", err)
+			}
+		}
+
+		// delete all packed objects
+		packs := make(map[string]bool)
+		for hash, data := range saved {
+			packs[packKey(pack.index[fmt.Sprintf("%d-%s", len(data), hash)])] = true
+		}
+		entries, err = bin.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if _, ok := saved[entry.Hash]; !ok {
+				continue
+			}
+			err = bin.Delete(entry.Length, entry.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = bin.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for hash, data := range saved {
+			exists, err := bin.Exists(len(data), hash)
+			if err != nil || exists {
+				t.Fatal("deleted object exists")
+			}
+		}
+		for key := range packs {
+			length, hash, _ := hashbin.ParseKey(key)
+			exists, err := backend.Exists(length, hash)
+			if err != nil || exists {
+				t.Fatal("empty pack not deleted")
+			}
+		}
+	}
+}
+
+func TestPackWriters(t *testing.T) {
+	backend := hashbin.NewMembin()
+	saved := make(map[string][]byte)
+	for _, writer := range []string{"a", "b"} {
+		pack, err := New(backend, "test", writer, 1024*1024, 256*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin := hashbin.New(pack)
+		// a segment per flush, compacted when the chain is long
+		for i := 0; i < MAX_SEGMENTS+5; i++ {
+			data, hash := randData(1024)
+			err = bin.Save(len(data), hash, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved[hash] = data
+			err = bin.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pack.pending) > 0 || pack.chain > MAX_SEGMENTS {
+				t.Fatalf("chain of %d segments", pack.chain)
+			}
+		}
+		if pack.chain != 5 {
+			t.Fatalf("chain of %d segments not compacted", pack.chain)
+		}
+	}
+
+	// objects of both writers are indexed
+	pack, err := New(backend, "test", "c", 1024*1024, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(pack)
+	for hash, data := range saved {
+		buf := new(bytes.Buffer)
+		err = bin.Fetch(len(data), hash, buf)
+		if err != nil || !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("fetch packed by other writer: %v", err)
+		}
+	}
+
+	// deletes by one writer win over older adds of another
+	var deleted string
+	for hash, data := range saved {
+		err = bin.Delete(len(data), hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted = hash
+		break
+	}
+	err = bin.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err = New(backend, "test", "a", 1024*1024, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := pack.Exists(len(saved[deleted]), deleted)
+	if err != nil || exists {
+		t.Fatal("deleted object exists")
+	}
+	if len(pack.index) != len(saved)-1 {
+		t.Fatalf("%d objects indexed", len(pack.index))
+	}
+}
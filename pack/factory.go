@@ -0,0 +1,37 @@
+package pack
+
+import (
+	"../hashbin"
+	"../utils"
+	"os"
+)
+
+func init() {
+	hashbin.RegisterFactory("pack", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		backend, err := env.Open(spec.Param("backend", ""))
+		if err != nil {
+			return nil, err
+		}
+		sizes := map[string]int{
+			"threshold": DEFAULT_THRESHOLD,
+			"size":      DEFAULT_PACK_SIZE,
+		}
+		for name := range sizes {
+			if value := spec.Param(name, ""); value != "" {
+				sizes[name], err = utils.ParseSize(value)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		// machines sharing the backend append to their own index
+		writer := spec.Param("writer", "")
+		if writer == "" {
+			writer, err = os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return New(backend, spec.Param("name", env.Name), writer, sizes["threshold"], sizes["size"])
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"./hashbin"
+	"errors"
+	"fmt"
+	"log"
+)
+
+func (self *App) runPull() {
+	backend, err := self.getBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = self.pullSnapshots(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (self *App) pullSnapshots(backend *hashbin.Bin) error {
+	fmt.Printf("fetching snapshot manifest\n")
+	snapshots, forgotten, err := self.snapshotSet.Pull(backend)
+	if err != nil {
+		return err
+	}
+	known := len(self.snapshotSet.Forgotten)
+	added := self.snapshotSet.Merge(snapshots, forgotten)
+	fmt.Printf("%d snapshots in manifest, %d new\n", len(snapshots), added)
+	if added == 0 && len(self.snapshotSet.Forgotten) == known {
+		return nil
+	}
+	err = self.snapshotSet.Save(self.snapshotFilePath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save snapshot to file: %v", err))
+	}
+	return nil
+}
+
+func (self *App) pushSnapshots(backend *hashbin.Bin) error {
+	fmt.Printf("saving snapshot manifest\n")
+	err := self.snapshotSet.Push(backend)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot manifest saved\n")
+	return nil
+}
@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"../hashbin"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// a token bucket shared by all writers of a backend
+type Limiter struct {
+	sync.Mutex
+	schedule *Schedule
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	sleep    func(context.Context, time.Duration)
+}
+
+func NewLimiter(schedule *Schedule) *Limiter {
+	return &Limiter{
+		schedule: schedule,
+		now:      time.Now,
+		sleep:    sleep,
+	}
+}
+
+// returns early when ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// block until n bytes may be sent, or ctx is done
+func (self *Limiter) Wait(ctx context.Context, n int) error {
+	for n > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		self.Lock()
+		now := self.now()
+		rate := float64(self.schedule.RateAt(now))
+		if rate <= 0 {
+			self.tokens = 0
+			self.last = now
+			self.Unlock()
+			return nil
+		}
+		// at most one second of burst
+		if !self.last.IsZero() {
+			self.tokens += now.Sub(self.last).Seconds() * rate
+		}
+		if self.tokens > rate {
+			self.tokens = rate
+		}
+		self.last = now
+		take := float64(n)
+		if take > rate {
+			take = rate
+		}
+		if self.tokens >= take {
+			self.tokens -= take
+			n -= int(take)
+			self.Unlock()
+			continue
+		}
+		wait := time.Duration((take - self.tokens) / rate * float64(time.Second))
+		self.Unlock()
+		// recheck the schedule at least every second
+		if wait > time.Second {
+			wait = time.Second
+		}
+		self.sleep(ctx, wait)
+	}
+	return nil
+}
+
+// writes are throttled as they pass to the inner backend, which only limits
+// the network when it streams them out as they come, like baidu or kanbox.
+// a backend buffering objects, like pack, or a wrapper above one, sends them
+// later in bursts, so ratelimit must sit directly above the streaming backend.
+// s3 buffers each part of a multipart upload, so it bursts up to a part
+type RateLimit struct {
+	backend hashbin.Backend
+	limiter *Limiter
+}
+
+func New(backend hashbin.Backend, schedule *Schedule) *RateLimit {
+	return &RateLimit{
+		backend: backend,
+		limiter: NewLimiter(schedule),
+	}
+}
+
+type writer struct {
+	io.Writer
+	ctx     context.Context
+	limiter *Limiter
+}
+
+func (self *writer) Write(p []byte) (int, error) {
+	err := self.limiter.Wait(self.ctx, len(p))
+	if err != nil {
+		return 0, hashbin.Permanent(err)
+	}
+	return self.Writer.Write(p)
+}
+
+func (self *RateLimit) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *RateLimit) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	w, cb, err := hashbin.WithContext(self.backend).NewWriterContext(ctx, length, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &writer{w, ctx, self.limiter}, cb, nil
+}
+
+func (self *RateLimit) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.backend.NewReader(length, hash)
+}
+
+func (self *RateLimit) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return hashbin.WithContext(self.backend).NewReaderContext(ctx, length, hash)
+}
+
+func (self *RateLimit) NewRangeReader(length int, hash string, offset, size int) (io.Reader, hashbin.Callback, error) {
+	return hashbin.NewRangeReader(self.backend, length, hash, offset, size)
+}
+
+func (self *RateLimit) Flush() error {
+	return hashbin.Flush(self.backend)
+}
+
+func (self *RateLimit) Exists(length int, hash string) (bool, error) {
+	return self.backend.Exists(length, hash)
+}
+
+func (self *RateLimit) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	return hashbin.WithContext(self.backend).ExistsContext(ctx, length, hash)
+}
+
+func (self *RateLimit) ExistsBatch(ctx context.Context, keys []string) (map[string]bool, error) {
+	return hashbin.ExistsBatch(ctx, self.backend, keys)
+}
+
+func (self *RateLimit) MapKey(length int, hash string) (int, string) {
+	return hashbin.MapKey(self.backend, length, hash)
+}
+
+func (self *RateLimit) List() ([]hashbin.Entry, error) {
+	return hashbin.List(self.backend)
+}
+
+func (self *RateLimit) Delete(length int, hash string) error {
+	return hashbin.Delete(self.backend, length, hash)
+}
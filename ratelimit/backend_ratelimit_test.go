@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"../hashbin"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBackend(t *testing.T) {
+	schedule, err := ParseSchedule("1g", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(New(hashbin.NewMembin(), schedule))
+	hashbin.RunTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunContextTest(bin, t)
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("4m", "09:00-18:00=1m, 22:00-07:00=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int{
+		"08:59": 4 * 1024 * 1024,
+		"09:00": 1024 * 1024,
+		"17:59": 1024 * 1024,
+		"18:00": 4 * 1024 * 1024,
+		"23:30": 0,
+		"03:00": 0,
+		"07:00": 4 * 1024 * 1024,
+	}
+	for clock, expected := range cases {
+		tm, _ := time.Parse("15:04", clock)
+		if rate := schedule.RateAt(tm); rate != expected {
+			t.Fatalf("%s: rate %d, expected %d", clock, rate, expected)
+		}
+	}
+	for _, windows := range []string{"09:00=1m", "9-18=1m", "09:00-18:00", "09:00-18:00=x"} {
+		_, err = ParseSchedule("", windows)
+		if err == nil {
+			t.Fatalf("%s: no error", windows)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.Local)
+	lock := new(sync.Mutex)
+	limiter := NewLimiter(&Schedule{
+		Rate: 1000,
+		Windows: []Window{
+			{Start: 0, End: time.Hour * 6, Rate: 0},
+		},
+	})
+	limiter.now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+	limiter.sleep = func(ctx context.Context, d time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		now = now.Add(d)
+	}
+	start := now
+	// shared by concurrent writers
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				limiter.Wait(context.Background(), 250)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := now.Sub(start)
+	if elapsed < time.Second*9 || elapsed > time.Second*11 {
+		t.Fatalf("10000 bytes at 1000/s took %v", elapsed)
+	}
+
+	// unlimited window
+	now = time.Date(2014, 1, 2, 1, 0, 0, 0, time.Local)
+	start = now
+	limiter.Wait(context.Background(), 1000000)
+	if now != start {
+		t.Fatal("limited in unlimited window")
+	}
+
+	// cancelled while waiting
+	now = time.Date(2014, 1, 2, 12, 0, 0, 0, time.Local)
+	ctx, cancel := context.WithCancel(context.Background())
+	limiter.sleep = func(ctx context.Context, d time.Duration) {
+		cancel()
+	}
+	err := limiter.Wait(ctx, 1000000)
+	if err != context.Canceled {
+		t.Fatalf("wait not cancelled: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package ratelimit
+
+import (
+	"../hashbin"
+)
+
+func init() {
+	hashbin.RegisterFactory("ratelimit", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		// must be a streaming backend, see RateLimit
+		backend, err := env.Open(spec.Param("backend", ""))
+		if err != nil {
+			return nil, err
+		}
+		schedule, err := ParseSchedule(spec.Param("rate", ""), spec.Param("windows", ""))
+		if err != nil {
+			return nil, err
+		}
+		return New(backend, schedule), nil
+	})
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"../utils"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// bytes per second, 0 for unlimited
+type Window struct {
+	Start time.Duration // since midnight
+	End   time.Duration // may be before Start for windows spanning midnight
+	Rate  int
+}
+
+type Schedule struct {
+	Rate    int // outside of windows
+	Windows []Window
+}
+
+func (self *Schedule) RateAt(t time.Time) int {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, window := range self.Windows {
+		if window.Start <= window.End && offset >= window.Start && offset < window.End {
+			return window.Rate
+		}
+		if window.Start > window.End && (offset >= window.Start || offset < window.End) {
+			return window.Rate
+		}
+	}
+	return self.Rate
+}
+
+// rate like "1m", windows like "09:00-18:00=1m,22:00-07:00=0"
+func ParseSchedule(rate, windows string) (*Schedule, error) {
+	schedule := new(Schedule)
+	var err error
+	if rate != "" {
+		schedule.Rate, err = utils.ParseSize(rate)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid rate %s", rate))
+		}
+	}
+	if windows == "" {
+		return schedule, nil
+	}
+	for _, spec := range strings.Split(windows, ",") {
+		var window Window
+		parts := strings.SplitN(strings.TrimSpace(spec), "=", 2)
+		span := strings.SplitN(parts[0], "-", 2)
+		if len(parts) != 2 || len(span) != 2 {
+			return nil, errors.New(fmt.Sprintf("invalid window %s", spec))
+		}
+		window.Start, err = parseClock(span[0])
+		if err == nil {
+			window.End, err = parseClock(span[1])
+		}
+		if err == nil {
+			window.Rate, err = utils.ParseSize(parts[1])
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid window %s", spec))
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	return schedule, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
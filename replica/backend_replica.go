@@ -0,0 +1,457 @@
+package replica
+
+import (
+	"../hashbin"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// semantics of Exists
+const (
+	EXISTS_ALL = iota
+	EXISTS_ANY
+)
+
+// objects are stored with their own SHA-512 in front, the key hash may not be the
+// hash of the data, e.g. under crypt
+func storedLength(length int) int {
+	return sha512.Size + length
+}
+
+type Replica struct {
+	backends   []hashbin.Backend // in read preference order
+	quorum     int
+	existsMode int
+	// children store objects under the same keys, so List and Delete are meaningful
+	sameKeys bool
+
+	healthLock sync.Mutex
+	health     []Health
+
+	// keys saved without some backends, copied to them on Flush
+	missingLock     sync.Mutex
+	missing         map[string]map[int]bool
+	missingFilePath string
+	repairLock      sync.Mutex
+}
+
+type Health struct {
+	Writes    int
+	Failures  int
+	LastError error
+	Missing   int // objects waiting for repair
+}
+
+// missing keys are kept in missingFilePath between runs, in memory only if empty
+func New(backends []hashbin.Backend, quorum int, existsMode int, missingFilePath string) (*Replica, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no backend")
+	}
+	if quorum <= 0 || quorum > len(backends) {
+		return nil, errors.New(fmt.Sprintf("invalid quorum %d of %d backends", quorum, len(backends)))
+	}
+	if existsMode != EXISTS_ALL && existsMode != EXISTS_ANY {
+		return nil, errors.New(fmt.Sprintf("unknown exists mode %d", existsMode))
+	}
+	probe := fmt.Sprintf("%x", sha512.Sum512([]byte("FileStore replica probe")))
+	sameKeys := true
+	length, hash := hashbin.MapKey(backends[0], len(probe), probe)
+	for _, backend := range backends[1:] {
+		l, h := hashbin.MapKey(backend, len(probe), probe)
+		if l != length || h != hash {
+			sameKeys = false
+		}
+	}
+	replica := &Replica{
+		backends:        backends,
+		quorum:          quorum,
+		existsMode:      existsMode,
+		sameKeys:        sameKeys,
+		health:          make([]Health, len(backends)),
+		missing:         make(map[string]map[int]bool),
+		missingFilePath: missingFilePath,
+	}
+	if missingFilePath != "" {
+		f, err := os.Open(missingFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.New(fmt.Sprintf("cannot open missing file: %v", err))
+		}
+		if err == nil {
+			err = gob.NewDecoder(f).Decode(&replica.missing)
+			f.Close()
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("cannot decode missing file: %v", err))
+			}
+		}
+		for key, indexes := range replica.missing {
+			for i := range indexes {
+				if i >= len(backends) {
+					// backends changed, the object is checked by the next upload
+					delete(replica.missing, key)
+				}
+			}
+		}
+	}
+	return replica, nil
+}
+
+func ParseExistsMode(name string) (int, error) {
+	switch name {
+	case "all":
+		return EXISTS_ALL, nil
+	case "any":
+		return EXISTS_ANY, nil
+	}
+	return 0, errors.New(fmt.Sprintf("unknown exists mode %s", name))
+}
+
+func (self *Replica) Health() []Health {
+	self.healthLock.Lock()
+	defer self.healthLock.Unlock()
+	health := make([]Health, len(self.health))
+	copy(health, self.health)
+	self.missingLock.Lock()
+	defer self.missingLock.Unlock()
+	for _, indexes := range self.missing {
+		for i := range indexes {
+			health[i].Missing++
+		}
+	}
+	return health
+}
+
+func (self *Replica) record(i int, err error) {
+	self.healthLock.Lock()
+	defer self.healthLock.Unlock()
+	self.health[i].Writes++
+	if err != nil {
+		self.health[i].Failures++
+		self.health[i].LastError = err
+	}
+}
+
+func save(ctx context.Context, backend hashbin.Backend, length int, hash string, data []byte) error {
+	writer, cb, err := hashbin.WithContext(backend).NewWriterContext(ctx, storedLength(length), hash)
+	if err != nil {
+		return err
+	}
+	sum := sha512.Sum512(data)
+	_, err = writer.Write(sum[:])
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if cb != nil {
+		err = cb(err)
+	}
+	return err
+}
+
+// written to all backends concurrently, succeeds if a quorum of them succeed.
+// backends that failed get the object on Flush
+func (self *Replica) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *Replica) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	buf := new(bytes.Buffer)
+	return buf, func(err error) error {
+		if err != nil {
+			return err
+		}
+		errs := make([]error, len(self.backends))
+		wg := new(sync.WaitGroup)
+		for i, backend := range self.backends {
+			wg.Add(1)
+			go func(i int, backend hashbin.Backend) {
+				defer wg.Done()
+				errs[i] = save(ctx, backend, length, hash, buf.Bytes())
+				// a cancelled write is not a failure of the backend
+				if ctx.Err() == nil {
+					self.record(i, errs[i])
+				}
+			}(i, backend)
+		}
+		wg.Wait()
+		succeeded := 0
+		messages := make([]string, 0)
+		failed := make(map[int]bool)
+		for i, err := range errs {
+			if err == nil {
+				succeeded++
+			} else {
+				messages = append(messages, fmt.Sprintf("backend %d: %v", i, err))
+				failed[i] = true
+			}
+		}
+		if succeeded < self.quorum {
+			return errors.New(fmt.Sprintf("saved to %d of %d backends, quorum %d: %s",
+				succeeded, len(self.backends), self.quorum, strings.Join(messages, "; ")))
+		}
+		key := fmt.Sprintf("%d-%s", length, hash)
+		self.missingLock.Lock()
+		if len(failed) > 0 {
+			self.missing[key] = failed
+		} else {
+			delete(self.missing, key)
+		}
+		self.missingLock.Unlock()
+		return nil
+	}, nil
+}
+
+func fetch(ctx context.Context, backend hashbin.Backend, length int, hash string) ([]byte, error) {
+	reader, cb, err := hashbin.WithContext(backend).NewReaderContext(ctx, storedLength(length), hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(storedLength(length))+1))
+	if cb != nil {
+		err = cb(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != storedLength(length) {
+		return nil, errors.New("data corrupted")
+	}
+	sum := sha512.Sum512(data[sha512.Size:])
+	if !bytes.Equal(sum[:], data[:sha512.Size]) {
+		return nil, errors.New("data corrupted")
+	}
+	return data[sha512.Size:], nil
+}
+
+// tried in preference order, falling back on errors or corrupted data.
+// backends waiting for repair of the object are skipped
+func (self *Replica) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *Replica) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	// backends that missed the last write may hold a stale ref
+	self.missingLock.Lock()
+	missing := self.missing[fmt.Sprintf("%d-%s", length, hash)]
+	self.missingLock.Unlock()
+	messages := make([]string, 0)
+	for i, backend := range self.backends {
+		if missing[i] {
+			continue
+		}
+		data, err := fetch(ctx, backend, length, hash)
+		if err == nil {
+			return bytes.NewReader(data), nil, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		messages = append(messages, fmt.Sprintf("backend %d: %v", i, err))
+	}
+	return nil, nil, errors.New(fmt.Sprintf("fetch failed: %s", strings.Join(messages, "; ")))
+}
+
+// backends failing to answer count as not having the object, unless none answers
+func (self *Replica) Exists(length int, hash string) (bool, error) {
+	return self.ExistsContext(context.Background(), length, hash)
+}
+
+func (self *Replica) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	answered := 0
+	found := 0
+	var firstErr error
+	for _, backend := range self.backends {
+		exists, err := hashbin.WithContext(backend).ExistsContext(ctx, storedLength(length), hash)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		answered++
+		if exists {
+			found++
+			if self.existsMode == EXISTS_ANY {
+				return true, nil
+			}
+		}
+	}
+	if answered == 0 {
+		return false, firstErr
+	}
+	return found == len(self.backends), nil
+}
+
+func (self *Replica) MapKey(length int, hash string) (int, string) {
+	return hashbin.MapKey(self.backends[0], storedLength(length), hash)
+}
+
+// repairs missing objects and flushes all backends, fails if any flush fails.
+// objects still missing are kept for the next Flush, they are readable from other backends
+func (self *Replica) Flush() error {
+	self.repairLock.Lock()
+	defer self.repairLock.Unlock()
+	self.repair()
+	err := self.saveMissing()
+	if err != nil {
+		return err
+	}
+	messages := make([]string, 0)
+	for i, backend := range self.backends {
+		err := hashbin.Flush(backend)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("backend %d: %v", i, err))
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(fmt.Sprintf("flush failed: %s", strings.Join(messages, "; ")))
+	}
+	return nil
+}
+
+// with repairLock held
+func (self *Replica) repair() {
+	self.missingLock.Lock()
+	missing := make(map[string]map[int]bool)
+	for key, indexes := range self.missing {
+		missing[key] = indexes
+	}
+	self.missingLock.Unlock()
+
+	for key, indexes := range missing {
+		length, hash, err := hashbin.ParseKey(key)
+		if err != nil {
+			continue
+		}
+		var data []byte
+		for i, backend := range self.backends {
+			if indexes[i] {
+				continue
+			}
+			data, err = fetch(context.Background(), backend, length, hash)
+			if err == nil {
+				break
+			}
+		}
+		if data == nil {
+			continue
+		}
+		left := make(map[int]bool)
+		for i := range indexes {
+			err = save(context.Background(), self.backends[i], length, hash, data)
+			self.record(i, err)
+			if err != nil {
+				left[i] = true
+			}
+		}
+		self.missingLock.Lock()
+		// unless written again meanwhile
+		if current, ok := self.missing[key]; ok && sameIndexes(current, indexes) {
+			if len(left) > 0 {
+				self.missing[key] = left
+			} else {
+				delete(self.missing, key)
+			}
+		}
+		self.missingLock.Unlock()
+	}
+}
+
+func sameIndexes(a, b map[int]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// saved before backends are flushed, so an object is never journaled unless
+// it is on every backend or recorded here
+func (self *Replica) saveMissing() error {
+	if self.missingFilePath == "" {
+		return nil
+	}
+	f, err := os.Create(self.missingFilePath + ".new")
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot open missing file: %v", err))
+	}
+	self.missingLock.Lock()
+	err = gob.NewEncoder(f).Encode(self.missing)
+	self.missingLock.Unlock()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot write missing file: %v", err))
+	}
+	return os.Rename(self.missingFilePath+".new", self.missingFilePath)
+}
+
+// entries are named by stored keys, see MapKey
+func (self *Replica) List() ([]hashbin.Entry, error) {
+	if !self.sameKeys {
+		return nil, hashbin.ErrNotSupported
+	}
+	entries := make([]hashbin.Entry, 0)
+	index := make(map[string]int)
+	for _, backend := range self.backends {
+		list, err := hashbin.List(backend)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list {
+			key := fmt.Sprintf("%d-%s", entry.Length, entry.Hash)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(entries)
+				entries = append(entries, entry)
+				continue
+			}
+			// the most recent one, unknown times count as recent
+			if entries[i].Time.IsZero() || entry.Time.IsZero() {
+				entries[i].Time = time.Time{}
+			} else if entry.Time.After(entries[i].Time) {
+				entries[i].Time = entry.Time
+			}
+		}
+	}
+	return entries, nil
+}
+
+// deleted from every backend, fails only if no backend deleted it.
+// takes stored keys, see List
+func (self *Replica) Delete(length int, hash string) error {
+	if !self.sameKeys {
+		return hashbin.ErrNotSupported
+	}
+	self.missingLock.Lock()
+	delete(self.missing, fmt.Sprintf("%d-%s", length-sha512.Size, hash))
+	self.missingLock.Unlock()
+	deleted := 0
+	messages := make([]string, 0)
+	for i, backend := range self.backends {
+		err := hashbin.Delete(backend, length, hash)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("backend %d: %v", i, err))
+			continue
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return errors.New(fmt.Sprintf("delete failed: %s", strings.Join(messages, "; ")))
+	}
+	return nil
+}
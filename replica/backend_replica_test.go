@@ -0,0 +1,204 @@
+package replica
+
+import (
+	"../crypt"
+	"../hashbin"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// a child backend that is down or returns corrupted data
+type faulty struct {
+	hashbin.Backend
+	down    bool
+	corrupt bool
+}
+
+var errDown = errors.New("down")
+
+func (self *faulty) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	if self.down {
+		return nil, nil, errDown
+	}
+	return self.Backend.NewWriter(length, hash)
+}
+
+func (self *faulty) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	if self.down {
+		return nil, nil, errDown
+	}
+	if self.corrupt {
+		return bytes.NewReader(make([]byte, length)), nil, nil
+	}
+	return self.Backend.NewReader(length, hash)
+}
+
+func (self *faulty) Exists(length int, hash string) (bool, error) {
+	if self.down {
+		return false, errDown
+	}
+	return self.Backend.Exists(length, hash)
+}
+
+func (self *faulty) List() ([]hashbin.Entry, error) {
+	return hashbin.List(self.Backend)
+}
+
+func (self *faulty) Delete(length int, hash string) error {
+	return hashbin.Delete(self.Backend, length, hash)
+}
+
+func TestReplicaBackend(t *testing.T) {
+	children := []*faulty{
+		&faulty{Backend: hashbin.NewMembin()},
+		&faulty{Backend: hashbin.NewMembin()},
+		&faulty{Backend: hashbin.NewMembin()},
+	}
+	backends := []hashbin.Backend{children[0], children[1], children[2]}
+	missingFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingFile.Close()
+	os.Remove(missingFile.Name())
+	defer os.Remove(missingFile.Name())
+	replica, err := New(backends, 2, EXISTS_ALL, missingFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(replica)
+	hashbin.RunTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunContextTest(bin, t)
+	hashbin.RunRefTest(bin, t)
+
+	data := make([]byte, 4096)
+	rand.Read(data)
+	hash := fmt.Sprintf("%x", sha512.Sum512(data))
+
+	// one backend down
+	children[2].down = true
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Health()[2].Failures == 0 || replica.Health()[0].Failures != 0 {
+		t.Fatal("health not recorded")
+	}
+	exists, err := bin.Exists(len(data), hash)
+	if err != nil || exists {
+		t.Fatal("exists on all backends while one is down")
+	}
+	children[2].down = false
+	exists, err = bin.Exists(len(data), hash)
+	if err != nil || exists {
+		t.Fatal("exists on all backends while missing in one")
+	}
+	anyReplica, err := New(backends, 1, EXISTS_ANY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err = anyReplica.Exists(len(data), hash)
+	if err != nil || !exists {
+		t.Fatal("not exists on any backend")
+	}
+
+	// missing objects are kept between runs and repaired on flush
+	if replica.Health()[2].Missing != 1 {
+		t.Fatal("missing object not recorded")
+	}
+	children[2].down = true
+	err = bin.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	children[2].down = false
+	reopened, err := New(backends, 2, EXISTS_ALL, missingFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Health()[2].Missing != 1 {
+		t.Fatal("missing object not saved")
+	}
+	err = reopened.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Health()[2].Missing != 0 {
+		t.Fatal("missing object not repaired")
+	}
+	exists, err = bin.Exists(len(data), hash)
+	if err != nil || !exists {
+		t.Fatal("not exists on all backends after repair")
+	}
+
+	// read fallback
+	children[0].corrupt = true
+	children[1].down = true
+	children[2].down = true
+	buf := new(bytes.Buffer)
+	err = bin.Fetch(len(data), hash, buf)
+	if err == nil {
+		t.Fatal("fetched corrupted data")
+	}
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("saved without quorum")
+	}
+	children[1].down = false
+	children[2].down = false
+	buf.Reset()
+	err = bin.Fetch(len(data), hash, buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("fallback fetch: %v", err)
+	}
+
+	// a ref missed by the first backend is read from the others
+	children[0].corrupt = false
+	err = bin.SaveRef("stale", len(data), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sha512.Sum512([]byte("other"))
+	children[0].down = true
+	err = bin.SaveRef("stale", 5, fmt.Sprintf("%x", other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	children[0].down = false
+	length, _, err := bin.LoadRef("stale")
+	if err != nil || length != 5 {
+		t.Fatalf("stale ref loaded: %v", err)
+	}
+
+	_, err = New(backends, 4, EXISTS_ALL, "")
+	if err == nil {
+		t.Fatal("quorum larger than backends accepted")
+	}
+}
+
+// crypt stores objects under names that are not hashes of the stored data
+func TestCryptOver(t *testing.T) {
+	key, err := crypt.DeriveKey("passphrase", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := New([]hashbin.Backend{hashbin.NewMembin(), hashbin.NewMembin()}, 1, EXISTS_ALL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypted, err := crypt.New(replica, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(crypted)
+	hashbin.RunTest(bin, t)
+	hashbin.RunRefTest(bin, t)
+}
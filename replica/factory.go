@@ -0,0 +1,38 @@
+package replica
+
+import (
+	"../hashbin"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	hashbin.RegisterFactory("replica", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		backends := make([]hashbin.Backend, 0)
+		for _, name := range strings.Split(spec.Param("backends", ""), ",") {
+			backend, err := env.Open(strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, backend)
+		}
+		// one backend may be down
+		defaultQuorum := len(backends) - 1
+		if defaultQuorum < 1 {
+			defaultQuorum = 1
+		}
+		quorum, err := strconv.Atoi(spec.Param("quorum", strconv.Itoa(defaultQuorum)))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid quorum %s", spec.Param("quorum", "")))
+		}
+		existsMode, err := ParseExistsMode(spec.Param("exists", "all"))
+		if err != nil {
+			return nil, err
+		}
+		missingFilePath := spec.Param("missing", filepath.Join(env.DataDir, env.Name+".missing"))
+		return New(backends, quorum, existsMode, missingFilePath)
+	})
+}
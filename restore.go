@@ -0,0 +1,231 @@
+package main
+
+import (
+	"./hashbin"
+	"./snapshot"
+	"./utils"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func (self *App) runRestore() {
+	var selector string
+	for _, flag := range self.flags {
+		if strings.HasPrefix(flag, "--snapshot=") {
+			selector = strings.TrimPrefix(flag, "--snapshot=")
+		} else {
+			fmt.Printf("unknown option %s\n", flag)
+			os.Exit(0)
+		}
+	}
+
+	target := self.path
+	args := self.args
+	if len(args) > 0 {
+		var err error
+		target, err = filepath.Abs(args[0])
+		if err != nil {
+			log.Fatalf("invalid target: %v", err)
+		}
+		args = args[1:]
+	}
+	matchPatterns := compilePatterns(args)
+
+	backend, err := self.getBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(self.snapshotSet.Snapshots) == 0 {
+		err = self.pullSnapshots(backend)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	snap, err := self.selectSnapshot(selector)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(0)
+	}
+
+	paths := make([]string, 0, len(snap.Files))
+	for path := range snap.Files {
+		if !self.matchPath(matchPatterns, path) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fmt.Printf("restoring %d files from snapshot %v to %s\n", len(paths), snap.Time, target)
+	var restored int64
+	done := 0
+	failed := 0
+	dirs := make([]string, 0)
+	for i, path := range paths {
+		if self.ctx.Err() != nil {
+			break
+		}
+		file := snap.Files[path]
+		targetPath := filepath.Join(target, self.relativePath(path))
+		fmt.Printf("=> file %d / %d: %s\n", i+1, len(paths), targetPath)
+		switch file.Type {
+		case snapshot.TYPE_DIR:
+			err = restoreDir(targetPath)
+			dirs = append(dirs, path)
+		case snapshot.TYPE_SYMLINK:
+			err = restoreSymlink(file, targetPath)
+		default:
+			err = restoreFile(self.ctx, backend, file, targetPath)
+		}
+		if err == nil && file.Type != snapshot.TYPE_DIR {
+			err = restoreMetadata(file, targetPath)
+		}
+		if err != nil && self.ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			fmt.Printf("restore %s error: %v\n", targetPath, err)
+			failed++
+			continue
+		}
+		restored += file.Size
+		done++
+	}
+	// directories last, since restoring their entries changes their times
+	for i := len(dirs) - 1; i >= 0; i-- {
+		targetPath := filepath.Join(target, self.relativePath(dirs[i]))
+		err = restoreMetadata(snap.Files[dirs[i]], targetPath)
+		if err != nil {
+			fmt.Printf("restore %s error: %v\n", targetPath, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("restored %d files, %s\n", done, utils.FormatSize(int(restored)))
+	if self.ctx.Err() != nil {
+		fmt.Printf("interrupted, %d files not restored\n", len(paths)-done-failed)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		fmt.Printf("%d files failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+// a symlink or other non-directory at the path is replaced, not followed
+func restoreDir(path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && !info.IsDir() {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+// a partially restored file is removed. a symlink or other non-regular file
+// at the path is replaced, not followed
+func restoreFile(ctx context.Context, backend *hashbin.Bin, file *snapshot.File, path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode().IsRegular() && info.Size() == file.Size && info.ModTime().Equal(file.ModTime) {
+		fmt.Printf("skip %s\n", path)
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".restoring"
+	os.Remove(tmpPath)
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(file.Size)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	buf := new(bytes.Buffer)
+	for _, chunk := range file.Chunks {
+		buf.Reset()
+		err = backend.FetchContext(ctx, int(chunk.Length), chunk.Hash, buf)
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return errors.New(fmt.Sprintf("fetch chunk at %d: %v", chunk.Offset, err))
+		}
+		_, err = f.WriteAt(buf.Bytes(), chunk.Offset)
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Chtimes(tmpPath, file.ModTime, file.ModTime)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func restoreSymlink(file *snapshot.File, path string) error {
+	if target, err := os.Readlink(path); err == nil && target == file.Target {
+		fmt.Printf("skip %s\n", path)
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".restoring"
+	os.Remove(tmpPath)
+	err = os.Symlink(file.Target, tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// owners are restored only when running as root
+func restoreMetadata(file *snapshot.File, path string) error {
+	if file.Type == snapshot.TYPE_NONE { // recorded without metadata
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		// before chmod, since chown clears the setuid and setgid bits
+		err := os.Lchown(path, file.Uid, file.Gid)
+		if err != nil {
+			return err
+		}
+	}
+	if file.Type == snapshot.TYPE_SYMLINK { // mode and times of symlinks are not used
+		return nil
+	}
+	err := os.Chmod(path, file.Mode)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, file.ModTime, file.ModTime)
+}
@@ -0,0 +1,447 @@
+package s3
+
+import (
+	"../hashbin"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_PART_SIZE = 8 * 1024 * 1024
+	// s3 rejects smaller parts except the last one
+	MIN_PART_SIZE = 5 * 1024 * 1024
+)
+
+type Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PartSize  int
+}
+
+type S3 struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	partSize int
+	signer   *signer
+	client   *http.Client
+}
+
+func New(config *Config) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("endpoint and bucket required")
+	}
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	partSize := config.PartSize
+	if partSize <= 0 {
+		partSize = DEFAULT_PART_SIZE
+	}
+	if partSize < MIN_PART_SIZE {
+		return nil, errors.New(fmt.Sprintf("part size %d below the minimum %d", partSize, MIN_PART_SIZE))
+	}
+	return &S3{
+		endpoint: strings.TrimSuffix(config.Endpoint, "/"),
+		bucket:   config.Bucket,
+		prefix:   strings.Trim(config.Prefix, "/"),
+		partSize: partSize,
+		signer: &signer{
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			region:    region,
+			service:   "s3",
+		},
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.DialTimeout(network, addr, time.Second*30)
+				},
+				ResponseHeaderTimeout: time.Minute * 3,
+			},
+		},
+	}, nil
+}
+
+func (self *S3) key(length int, hash string) string {
+	key := fmt.Sprintf("%s/%d-%s", hash[:2], length, hash)
+	if self.prefix != "" {
+		key = self.prefix + "/" + key
+	}
+	return key
+}
+
+func (self *S3) do(method, key, query string, body []byte) (*http.Response, error) {
+	return self.doContext(context.Background(), method, key, query, body, nil)
+}
+
+func (self *S3) doWithHeader(method, key, query string, body []byte, header http.Header) (*http.Response, error) {
+	return self.doContext(context.Background(), method, key, query, body, header)
+}
+
+// extra headers are not signed
+func (self *S3) doContext(ctx context.Context, method, key, query string, body []byte, header http.Header) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s", self.endpoint, self.bucket)
+	if key != "" {
+		url += "/" + key
+	}
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	payloadHash := EMPTY_PAYLOAD_HASH
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	self.signer.sign(req, payloadHash, time.Now())
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return self.client.Do(req)
+}
+
+type errorResponse struct {
+	Code    string
+	Message string
+}
+
+// client errors other than timeouts and throttling are permanent
+func responseError(resp *http.Response) error {
+	err := serverError(resp)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != 429 {
+		return hashbin.Permanent(err)
+	}
+	return err
+}
+
+func serverError(resp *http.Response) error {
+	buf := new(bytes.Buffer)
+	_, err := io.Copy(buf, resp.Body)
+	if err != nil {
+		return errors.New("response body read error")
+	}
+	var e errorResponse
+	err = xml.Unmarshal(buf.Bytes(), &e)
+	if err != nil || e.Code == "" {
+		return errors.New(fmt.Sprintf("server error %d", resp.StatusCode))
+	}
+	return errors.New(fmt.Sprintf("server error %d %s %s", resp.StatusCode, e.Code, e.Message))
+}
+
+// objects larger than a part are sent as multipart uploads while being written,
+// so at most one part is buffered. the object is committed in the callback
+func (self *S3) NewWriter(length int, hash string) (io.Writer, hashbin.Callback, error) {
+	return self.NewWriterContext(context.Background(), length, hash)
+}
+
+func (self *S3) NewWriterContext(ctx context.Context, length int, hash string) (io.Writer, hashbin.Callback, error) {
+	w := &writer{
+		ctx: ctx,
+		s3:  self,
+		key: self.key(length, hash),
+		buf: new(bytes.Buffer),
+	}
+	return w, func(err error) error {
+		if err == nil {
+			err = w.finish()
+		}
+		if err != nil && w.uploadId != "" {
+			self.abortMultipart(w.key, w.uploadId)
+		}
+		return err
+	}, nil
+}
+
+type writer struct {
+	ctx      context.Context
+	s3       *S3
+	key      string
+	buf      *bytes.Buffer
+	uploadId string
+	parts    []completedPart
+}
+
+func (self *writer) Write(p []byte) (int, error) {
+	self.buf.Write(p)
+	// keep the last part for finish, which must not be empty
+	for self.buf.Len() > self.s3.partSize {
+		if self.uploadId == "" {
+			uploadId, err := self.s3.initiateMultipart(self.ctx, self.key)
+			if err != nil {
+				return 0, err
+			}
+			self.uploadId = uploadId
+		}
+		err := self.uploadPart(self.buf.Next(self.s3.partSize))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (self *writer) uploadPart(data []byte) error {
+	n := len(self.parts) + 1
+	etag, err := self.s3.uploadPart(self.ctx, self.key, self.uploadId, n, data)
+	if err != nil {
+		return err
+	}
+	self.parts = append(self.parts, completedPart{
+		PartNumber: n,
+		ETag:       etag,
+	})
+	return nil
+}
+
+func (self *writer) finish() error {
+	if self.uploadId == "" {
+		return self.s3.put(self.ctx, self.key, self.buf.Bytes())
+	}
+	err := self.uploadPart(self.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return self.s3.completeMultipart(self.ctx, self.key, self.uploadId, self.parts)
+}
+
+func (self *S3) put(ctx context.Context, key string, data []byte) error {
+	resp, err := self.doContext(ctx, "PUT", key, "", data, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (self *S3) initiateMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := self.doContext(ctx, "POST", key, "uploads=", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	var initiate initiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("initiate multipart upload: %v", err))
+	}
+	return initiate.UploadId, nil
+}
+
+func (self *S3) uploadPart(ctx context.Context, key, uploadId string, n int, data []byte) (string, error) {
+	resp, err := self.doContext(ctx, "PUT", key, fmt.Sprintf("partNumber=%d&uploadId=%s", n, uploadId), data, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (self *S3) abortMultipart(key, uploadId string) {
+	resp, err := self.do("DELETE", key, "uploadId="+uploadId, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (self *S3) completeMultipart(ctx context.Context, key, uploadId string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{
+		Parts: parts,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := self.doContext(ctx, "POST", key, "uploadId="+uploadId, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	// errors may be reported in a 200 response
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, resp.Body)
+	if err != nil {
+		return errors.New("response body read error")
+	}
+	var e errorResponse
+	if xml.Unmarshal(buf.Bytes(), &e) == nil && e.Code != "" {
+		return errors.New(fmt.Sprintf("complete multipart upload: %s %s", e.Code, e.Message))
+	}
+	return nil
+}
+
+func (self *S3) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	return self.NewReaderContext(context.Background(), length, hash)
+}
+
+func (self *S3) NewReaderContext(ctx context.Context, length int, hash string) (io.Reader, hashbin.Callback, error) {
+	resp, err := self.doContext(ctx, "GET", self.key(length, hash), "", nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, nil, responseError(resp)
+	}
+	return resp.Body, func(err error) error {
+		resp.Body.Close()
+		return err
+	}, nil
+}
+
+func (self *S3) NewRangeReader(length int, hash string, offset, size int) (io.Reader, hashbin.Callback, error) {
+	if size == 0 {
+		return bytes.NewReader(nil), nil, nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	resp, err := self.doWithHeader("GET", self.key(length, hash), "", nil, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, nil, errors.New("range not supported by server")
+		}
+		return nil, nil, responseError(resp)
+	}
+	return resp.Body, func(err error) error {
+		resp.Body.Close()
+		return err
+	}, nil
+}
+
+func (self *S3) Exists(length int, hash string) (bool, error) {
+	return self.ExistsContext(context.Background(), length, hash)
+}
+
+func (self *S3) ExistsContext(ctx context.Context, length int, hash string) (bool, error) {
+	resp, err := self.doContext(ctx, "HEAD", self.key(length, hash), "", nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("server error %d", resp.StatusCode))
+}
+
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+	}
+}
+
+func (self *S3) List() ([]hashbin.Entry, error) {
+	entries := make([]hashbin.Entry, 0)
+	prefix := ""
+	if self.prefix != "" {
+		prefix = self.prefix + "/"
+	}
+	token := ""
+	for {
+		query := neturl.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := self.do("GET", "", query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("decode list result: %v", err))
+		}
+		for _, object := range result.Contents {
+			length, hash, err := hashbin.ParseKey(path.Base(object.Key))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, hashbin.Entry{
+				Length: length,
+				Hash:   hash,
+				Time:   object.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return entries, nil
+}
+
+func (self *S3) Delete(length int, hash string) error {
+	resp, err := self.do("DELETE", self.key(length, hash), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
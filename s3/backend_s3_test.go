@@ -0,0 +1,296 @@
+package s3
+
+import (
+	"../hashbin"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	s := &signer{
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		region:    "us-east-1",
+		service:   "iam",
+	}
+	s.sign(req, EMPTY_PAYLOAD_HASH, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Fatalf("bad signature %s", auth)
+	}
+}
+
+type fakeS3 struct {
+	sync.Mutex
+	signer     *signer
+	objects    map[string][]byte
+	uploads    map[string]map[int][]byte
+	multiparts int
+}
+
+func newFakeS3(accessKey, secretKey string) *fakeS3 {
+	return &fakeS3{
+		signer: &signer{
+			accessKey: accessKey,
+			secretKey: secretKey,
+			region:    "us-east-1",
+			service:   "s3",
+		},
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (self *fakeS3) multipartCount() int {
+	self.Lock()
+	defer self.Unlock()
+	return self.multiparts
+}
+
+func (self *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != sha256Hex(body) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+	// verify signature
+	auth := req.Header.Get("Authorization")
+	t, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	if err != nil {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	check, _ := http.NewRequest(req.Method, "http://"+req.Host+req.URL.RequestURI(), nil)
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "content-type" || strings.HasPrefix(key, "x-amz-") {
+			check.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	self.signer.sign(check, payloadHash, t)
+	if check.Header.Get("Authorization") != auth {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	key := req.URL.Path
+	query := req.URL.Query()
+	switch {
+	case req.Method == "POST" && query.Get("uploads") == "" && len(query["uploads"]) > 0:
+		id := strconv.Itoa(len(self.uploads) + 1)
+		self.uploads[id] = make(map[int][]byte)
+		self.multiparts++
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case req.Method == "PUT" && query.Get("uploadId") != "":
+		parts, ok := self.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", n))
+	case req.Method == "POST" && query.Get("uploadId") != "":
+		parts, ok := self.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete completeMultipartUpload
+		err = xml.Unmarshal(body, &complete)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		numbers := make([]int, 0, len(complete.Parts))
+		for _, part := range complete.Parts {
+			numbers = append(numbers, part.PartNumber)
+		}
+		sort.Ints(numbers)
+		data := new(bytes.Buffer)
+		for _, n := range numbers {
+			data.Write(parts[n])
+		}
+		self.objects[key] = data.Bytes()
+		delete(self.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case req.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(self.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "GET" && query.Get("list-type") == "2":
+		keys := make([]string, 0)
+		for k := range self.objects {
+			if strings.HasPrefix(k, key+"/"+query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		start := 0
+		if token := query.Get("continuation-token"); token != "" {
+			start, _ = strconv.Atoi(token)
+		}
+		end := start + 2 // small pages
+		truncated := end < len(keys)
+		if !truncated {
+			end = len(keys)
+		}
+		fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%v</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", truncated, end)
+		for _, k := range keys[start:end] {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>",
+				strings.TrimPrefix(k, key+"/"), time.Now().UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "</ListBucketResult>")
+	case req.Method == "DELETE":
+		delete(self.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "PUT":
+		self.objects[key] = body
+	case req.Method == "GET" || req.Method == "HEAD":
+		data, ok := self.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var start, end int
+		if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 && req.Method == "GET" {
+			if start > end || end >= len(data) {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func TestS3Backend(t *testing.T) {
+	fake := newFakeS3("access", "secret")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s3, err := New(&Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		Prefix:    "hashstorage",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  MIN_PART_SIZE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := hashbin.New(s3)
+	hashbin.RunTest(bin, t)
+	hashbin.RunListTest(bin, t)
+	hashbin.RunRangeTest(bin, t)
+	hashbin.RunContextTest(bin, t)
+
+	data := make([]byte, 2*MIN_PART_SIZE+42)
+	rand.Read(data)
+	hash := fmt.Sprintf("%x", sha512.Sum512(data))
+	err = bin.Save(len(data), hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = bin.Fetch(len(data), hash, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("fetch data incorrect")
+	}
+	if fake.multipartCount() == 0 {
+		t.Fatal("multipart upload not used")
+	}
+
+	// parts are sent while writing, a mismatch found at the end aborts the upload
+	badHash := strings.Repeat("0", 128)
+	err = bin.Save(len(data), badHash, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("mismatched data saved")
+	}
+	if fake.multipartCount() < 2 {
+		t.Fatal("multipart upload not started before the hash check")
+	}
+	exists, err := bin.Exists(len(data), badHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("mismatched data committed")
+	}
+	fake.Lock()
+	if len(fake.uploads) > 0 {
+		t.Fatal("multipart upload not completed or aborted")
+	}
+	for key := range fake.objects {
+		if !strings.HasPrefix(key, "/bucket/hashstorage/") {
+			t.Fatalf("bad object key %s", key)
+		}
+	}
+	fake.Unlock()
+
+	// parts below the s3 minimum are rejected
+	_, err = New(&Config{
+		Endpoint: server.URL,
+		Bucket:   "bucket",
+		PartSize: MIN_PART_SIZE - 1,
+	})
+	if err == nil {
+		t.Fatal("small part size accepted")
+	}
+
+	// wrong credentials
+	s3, err = New(&Config{
+		Endpoint:  server.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s3.Exists(1, "00")
+	if err == nil {
+		t.Fatal("request with wrong credentials accepted")
+	}
+}
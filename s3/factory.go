@@ -0,0 +1,21 @@
+package s3
+
+import (
+	"../hashbin"
+)
+
+func init() {
+	hashbin.RegisterFactory("s3", func(spec *hashbin.Spec, env *hashbin.Env) (hashbin.Backend, error) {
+		config := new(Config)
+		err := env.Credential(spec, "config", "s3_config", config)
+		if err != nil {
+			return nil, err
+		}
+		// params override the stored config
+		config.Endpoint = spec.Param("endpoint", config.Endpoint)
+		config.Region = spec.Param("region", config.Region)
+		config.Bucket = spec.Param("bucket", config.Bucket)
+		config.Prefix = spec.Param("prefix", config.Prefix)
+		return New(config)
+	})
+}
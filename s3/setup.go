@@ -0,0 +1,42 @@
+package s3
+
+import (
+	"../register"
+	"errors"
+	"fmt"
+)
+
+// the config is saved under the given register entry
+func Setup(register *register.Register, configKey string) error {
+	config := new(Config)
+	fields := []struct {
+		prompt   string
+		target   *string
+		optional bool
+	}{
+		{"endpoint (e.g. http://127.0.0.1:9000)", &config.Endpoint, false},
+		{"region (empty for us-east-1)", &config.Region, true},
+		{"bucket", &config.Bucket, false},
+		{"prefix (may be empty)", &config.Prefix, true},
+		{"access key", &config.AccessKey, false},
+		{"secret key", &config.SecretKey, false},
+	}
+	for _, field := range fields {
+		fmt.Printf("enter %s:\n", field.prompt)
+		n, err := fmt.Scanln(field.target)
+		if (n != 1 || err != nil) && !field.optional {
+			return errors.New(fmt.Sprintf("%s error: %v", field.prompt, err))
+		}
+	}
+
+	s3, err := New(config)
+	if err != nil {
+		return err
+	}
+	_, err = s3.Exists(0, "00")
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot access bucket: %v", err))
+	}
+
+	return register.Set(configKey, config)
+}
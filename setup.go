@@ -1,21 +1,63 @@
 package main
 
 import (
-	//"./baidu"
+	"./baidu"
+	"./crypt"
+	"./hashbin"
 	"./kanbox"
+	"./s3"
+	"fmt"
 	"log"
 )
 
+// set up credentials of the backend named by --backend, or the default one.
+// credentials are saved under the register entries configured for the backend
 func (self *App) runSetup() {
-	//TODO
-	// baidu
-	//err := baidu.Setup(self.register)
-	//if err != nil {
-	//	log.Fatalf("baidu setup: %v", err)
-	//}
+	name, err := self.backendName()
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec, err := self.backendSpec(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch spec.Type {
+	case "baidu":
+		err = baidu.Setup(self.register, spec.CredentialKey("token", "baidu_token"), spec.CredentialKey("dir", "baidu_dir"))
+	case "kanbox":
+		err = kanbox.Setup(spec.Param("dir", "hashstorage"), self.register, spec.CredentialKey("token", "kanbox_token"))
+	case "s3":
+		err = s3.Setup(self.register, spec.CredentialKey("config", "s3_config"))
+	case "crypt":
+		var backend hashbin.Backend
+		backend, err = self.openBackend(spec.Param("backend", ""))
+		if err == nil {
+			err = crypt.Setup(self.register, backend, spec.CredentialKey("key", "crypt_key"))
+		}
+	default:
+		fmt.Printf("nothing to set up for %s backend\n", spec.Type)
+		return
+	}
+	if err != nil {
+		log.Fatalf("%s setup: %v", spec.Type, err)
+	}
+}
 
-	err := kanbox.Setup("hashstorage", self.register)
+func (self *App) runRebuildKeys() {
+	name, err := self.backendName()
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend, err := self.openBackend(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, ok := backend.(*baidu.Baidu)
+	if !ok {
+		log.Fatalf("%s is not a baidu backend", name)
+	}
+	err = b.RebuildKeys()
 	if err != nil {
-		log.Fatalf("kanbox setup: %v", err)
+		log.Fatalf("rebuild keys: %v", err)
 	}
 }
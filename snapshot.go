@@ -2,14 +2,18 @@ package main
 
 import (
 	"./snapshot"
+	"./utils"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func (self *App) runSnapshot() {
 	var readCache bool
+	var tag string
 	strategy := snapshot.FULL_HASH
 	for _, flag := range self.flags {
 		if flag == "-c" || flag == "--continue" {
@@ -18,6 +22,21 @@ func (self *App) runSnapshot() {
 			strategy = snapshot.FAST_CHECK
 		} else if flag == "-fh" || flag == "--fast-hash" {
 			strategy = snapshot.FAST_HASH
+		} else if flag == "--cdc" || strings.HasPrefix(flag, "--cdc=") {
+			self.setChunking(flag)
+		} else if strings.HasPrefix(flag, "--workers=") || strings.HasPrefix(flag, "-j=") {
+			workers, err := strconv.Atoi(flag[strings.Index(flag, "=")+1:])
+			if err != nil || workers <= 0 {
+				fmt.Printf("invalid option %s\n", flag)
+				os.Exit(0)
+			}
+			self.snapshotSet.Workers = workers
+		} else if strings.HasPrefix(flag, "--tag=") {
+			tag = strings.TrimPrefix(flag, "--tag=")
+			if _, err := strconv.Atoi(tag); err == nil || tag == "" { // would be taken as an index
+				fmt.Printf("invalid option %s\n", flag)
+				os.Exit(0)
+			}
 		} else if flag[0] == '-' {
 			fmt.Printf("unknown option %s\n", flag)
 			os.Exit(0)
@@ -25,10 +44,15 @@ func (self *App) runSnapshot() {
 	}
 
 	cacheFilePath := filepath.Join(self.dataDir, self.escapedPath+".cache")
-	err := self.snapshotSet.Snapshot(cacheFilePath, readCache, strategy)
+	err := self.snapshotSet.SnapshotContext(self.ctx, cacheFilePath, readCache, strategy)
+	if err != nil && self.ctx.Err() != nil {
+		fmt.Printf("snapshot interrupted, checked files are cached, resume with --continue\n")
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Fatalf("snapshot error: %v", err)
 	}
+	self.snapshotSet.Snapshots[len(self.snapshotSet.Snapshots)-1].Tag = tag
 
 	fmt.Printf("saving snapshots\n")
 	err = self.snapshotSet.Save(self.snapshotFilePath)
@@ -37,3 +61,29 @@ func (self *App) runSnapshot() {
 	}
 	fmt.Printf("snapshots saved\n")
 }
+
+func (self *App) setChunking(flag string) {
+	sizes := []int{
+		snapshot.DEFAULT_CDC_MIN_SIZE,
+		snapshot.DEFAULT_CDC_AVG_SIZE,
+		snapshot.DEFAULT_CDC_MAX_SIZE,
+	}
+	if strings.HasPrefix(flag, "--cdc=") {
+		parts := strings.Split(strings.TrimPrefix(flag, "--cdc="), ",")
+		if len(parts) != 3 {
+			log.Fatalf("invalid option %s, expecting --cdc=MIN,AVG,MAX", flag)
+		}
+		for i, part := range parts {
+			size, err := utils.ParseSize(part)
+			if err != nil {
+				log.Fatalf("invalid option %s: %v", flag, err)
+			}
+			sizes[i] = size
+		}
+	}
+	chunking, err := snapshot.NewCDC(sizes[0], sizes[1], sizes[2])
+	if err != nil {
+		log.Fatalf("invalid option %s: %v", flag, err)
+	}
+	self.snapshotSet.Chunking = chunking
+}
@@ -0,0 +1,94 @@
+package snapshot
+
+import (
+	"context"
+	"sort"
+)
+
+type Changes struct {
+	Added     []string
+	Removed   []string
+	Modified  []string
+	Unchanged []string
+}
+
+// compare the current tree with the last snapshot, without recording a new one
+func (self *SnapshotSet) Check(strategy int) (*Changes, error) {
+	var lastSnapshotFiles map[string]*File
+	if len(self.Snapshots) > 0 {
+		lastSnapshotFiles = self.Snapshots[len(self.Snapshots)-1].Files
+	}
+	infos, paths, err := self.collect()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	if strategy != FAST_CHECK {
+		chunking := self.Chunking
+		if chunking == nil {
+			chunking = fixedChunking
+		}
+		buf = make([]byte, chunking.MaxSize)
+	}
+	changes := new(Changes)
+	seen := make(map[string]bool)
+	for i, info := range infos {
+		path := paths[i]
+		seen[path] = true
+		old, ok := lastSnapshotFiles[path]
+		if !ok {
+			changes.Added = append(changes.Added, path)
+			continue
+		}
+		file, err := newFile(path, info)
+		if err != nil {
+			return nil, err
+		}
+		if !sameMetadata(old, file) {
+			changes.Modified = append(changes.Modified, path)
+			continue
+		}
+		if strategy == FAST_CHECK {
+			// directory times change with their entries, which are checked on their own
+			if old.Size == file.Size && (old.ModTime.Equal(file.ModTime) || file.Type == TYPE_DIR) {
+				changes.Unchanged = append(changes.Unchanged, path)
+			} else {
+				changes.Modified = append(changes.Modified, path)
+			}
+			continue
+		}
+		err = file.getChunks(context.Background(), lastSnapshotFiles, strategy, self.Chunking, buf)
+		if err != nil {
+			return nil, err
+		}
+		if old.Size == file.Size && sameChunks(old.Chunks, file.Chunks) {
+			changes.Unchanged = append(changes.Unchanged, path)
+		} else {
+			changes.Modified = append(changes.Modified, path)
+		}
+	}
+	for path := range lastSnapshotFiles {
+		if !seen[path] {
+			changes.Removed = append(changes.Removed, path)
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+	sort.Strings(changes.Unchanged)
+	return changes, nil
+}
+
+func sameChunks(a, b []*Chunk) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, chunk := range a {
+		if chunk.Offset != b[i].Offset || chunk.Length != b[i].Length || chunk.Hash != b[i].Hash {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	FIXED_CHUNKING = iota
+	CDC_CHUNKING
+)
+
+const (
+	DEFAULT_CDC_MIN_SIZE = 512 * 1024
+	DEFAULT_CDC_AVG_SIZE = 2 * 1024 * 1024
+	DEFAULT_CDC_MAX_SIZE = 8 * 1024 * 1024
+)
+
+type Chunking struct {
+	Method  int
+	MinSize int
+	AvgSize int
+	MaxSize int
+	maskS   uint64
+	maskL   uint64
+}
+
+var fixedChunking = &Chunking{
+	Method:  FIXED_CHUNKING,
+	MaxSize: MAX_CHUNK_SIZE,
+}
+
+// content-defined chunking with a gear rolling hash (FastCDC)
+func NewCDC(minSize, avgSize, maxSize int) (*Chunking, error) {
+	if minSize <= 0 || minSize >= avgSize || avgSize >= maxSize {
+		return nil, errors.New(fmt.Sprintf("invalid chunk sizes %d %d %d", minSize, avgSize, maxSize))
+	}
+	if maxSize > MAX_CHUNK_SIZE {
+		return nil, errors.New(fmt.Sprintf("max chunk size larger than %d", MAX_CHUNK_SIZE))
+	}
+	bits := uint(0)
+	for (1 << (bits + 1)) <= avgSize {
+		bits++
+	}
+	return &Chunking{
+		Method:  CDC_CHUNKING,
+		MinSize: minSize,
+		AvgSize: avgSize,
+		MaxSize: maxSize,
+		// harder to match before the average size, easier after it
+		maskS: ^uint64(0) << (64 - (bits + 1)),
+		maskL: ^uint64(0) << (64 - (bits - 1)),
+	}, nil
+}
+
+// length of the next chunk in data. data is shorter than MaxSize only at end of file
+func (self *Chunking) cut(data []byte) int {
+	n := len(data)
+	if n > self.MaxSize {
+		n = self.MaxSize
+	}
+	if self.Method == FIXED_CHUNKING || n <= self.MinSize {
+		return n
+	}
+	normal := self.AvgSize
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := self.MinSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&self.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&self.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+var gear [256]uint64
+
+func init() {
+	// fixed seed, chunk boundaries must never change between versions
+	state := uint64(0x46696c6553746f72)
+	for i := range gear {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
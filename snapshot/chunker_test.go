@@ -0,0 +1,84 @@
+package snapshot
+
+import (
+	crand "crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCDC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunking, err := NewCDC(4*1024, 16*1024, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 4*1024*1024)
+	crand.Read(data)
+	path := filepath.Join(dir, "a")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &File{Path: path}
+	err = a.HashChunks(-1, chunking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(0)
+	for i, chunk := range a.Chunks {
+		if chunk.Offset != offset {
+			t.Fatalf("chunk %d at %d, expected %d", i, chunk.Offset, offset)
+		}
+		if chunk.Length > int64(chunking.MaxSize) {
+			t.Fatalf("chunk %d too large: %d", i, chunk.Length)
+		}
+		if chunk.Length < int64(chunking.MinSize) && i != len(a.Chunks)-1 {
+			t.Fatalf("chunk %d too small: %d", i, chunk.Length)
+		}
+		offset += chunk.Length
+	}
+	if offset != int64(len(data)) {
+		t.Fatalf("chunks cover %d bytes, expected %d", offset, len(data))
+	}
+
+	// insert one byte near the start
+	path = filepath.Join(dir, "b")
+	err = ioutil.WriteFile(path, append(append([]byte{}, data[:100]...), append([]byte{42}, data[100:]...)...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &File{Path: path}
+	err = b.HashChunks(-1, chunking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]bool)
+	for _, chunk := range a.Chunks {
+		hashes[chunk.Hash] = true
+	}
+	shared := 0
+	for _, chunk := range b.Chunks {
+		if hashes[chunk.Hash] {
+			shared++
+		}
+	}
+	if shared < len(b.Chunks)-2 {
+		t.Fatalf("only %d of %d chunks shared", shared, len(b.Chunks))
+	}
+
+	// fixed chunking
+	err = a.HashChunks(-1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Chunks) != 1 || a.Chunks[0].Length != int64(len(data)) {
+		t.Fatalf("fixed chunking produced %d chunks", len(a.Chunks))
+	}
+}
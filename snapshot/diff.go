@@ -0,0 +1,68 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+)
+
+type Diff struct {
+	Added    []string
+	Deleted  []string
+	Modified []string // modification time, mode or owner changed, same content
+	Changed  []string // chunk hashes, node type or symlink target changed
+	// chunks in b that are not in a
+	NewChunks int
+	NewBytes  int64
+}
+
+// compare two snapshots by path, size, metadata and chunk hashes
+func CompareSnapshots(a, b *Snapshot) *Diff {
+	diff := new(Diff)
+	known := make(map[string]bool)
+	for _, file := range a.Files {
+		for _, chunk := range file.Chunks {
+			known[fmt.Sprintf("%d-%s", chunk.Length, chunk.Hash)] = true
+		}
+	}
+	for path, file := range b.Files {
+		for _, chunk := range file.Chunks {
+			key := fmt.Sprintf("%d-%s", chunk.Length, chunk.Hash)
+			if known[key] {
+				continue
+			}
+			known[key] = true
+			diff.NewChunks++
+			diff.NewBytes += chunk.Length
+		}
+		old, ok := a.Files[path]
+		if !ok {
+			diff.Added = append(diff.Added, path)
+		} else if !sameContent(old, file) {
+			diff.Changed = append(diff.Changed, path)
+		} else if !sameMetadata(old, file) || !old.ModTime.Equal(file.ModTime) && file.Type != TYPE_DIR {
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+	for path := range a.Files {
+		if _, ok := b.Files[path]; !ok {
+			diff.Deleted = append(diff.Deleted, path)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Deleted)
+	sort.Strings(diff.Modified)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// regular files compare by chunks, symlinks by target
+func sameContent(a, b *File) bool {
+	if a.IsRegular() != b.IsRegular() {
+		return false
+	}
+	if a.IsRegular() {
+		return a.Size == b.Size && sameChunks(a.Chunks, b.Chunks)
+	}
+	return a.Type == b.Type && a.Target == b.Target
+}
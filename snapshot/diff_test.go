@@ -0,0 +1,55 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompareSnapshots(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	t1 := time.Unix(2000, 0)
+	chunk := func(offset, length int64, hash string) *Chunk {
+		return &Chunk{Offset: offset, Length: length, Hash: hash}
+	}
+	a := &Snapshot{
+		Files: map[string]*File{
+			"same":     &File{Size: 10, ModTime: t0, Chunks: []*Chunk{chunk(0, 10, "aa")}},
+			"touched":  &File{Size: 10, ModTime: t0, Chunks: []*Chunk{chunk(0, 10, "bb")}},
+			"changed":  &File{Size: 20, ModTime: t0, Chunks: []*Chunk{chunk(0, 10, "cc"), chunk(10, 10, "dd")}},
+			"deleted":  &File{Size: 10, ModTime: t0, Chunks: []*Chunk{chunk(0, 10, "ee")}},
+			"appended": &File{Size: 10, ModTime: t0, Chunks: []*Chunk{chunk(0, 10, "ff")}},
+		},
+	}
+	b := &Snapshot{
+		Files: map[string]*File{
+			"same":     &File{Size: 10, ModTime: t0, Chunks: []*Chunk{chunk(0, 10, "aa")}},
+			"touched":  &File{Size: 10, ModTime: t1, Chunks: []*Chunk{chunk(0, 10, "bb")}},
+			"changed":  &File{Size: 20, ModTime: t1, Chunks: []*Chunk{chunk(0, 10, "cc"), chunk(10, 10, "11")}},
+			"appended": &File{Size: 15, ModTime: t1, Chunks: []*Chunk{chunk(0, 10, "ff"), chunk(10, 5, "22")}},
+			"added":    &File{Size: 10, ModTime: t1, Chunks: []*Chunk{chunk(0, 10, "11")}},
+			"copied":   &File{Size: 10, ModTime: t1, Chunks: []*Chunk{chunk(0, 10, "ee")}},
+		},
+	}
+	diff := CompareSnapshots(a, b)
+	if len(diff.Added) != 2 || diff.Added[0] != "added" || diff.Added[1] != "copied" {
+		t.Fatalf("added %v", diff.Added)
+	}
+	if len(diff.Deleted) != 1 || diff.Deleted[0] != "deleted" {
+		t.Fatalf("deleted %v", diff.Deleted)
+	}
+	if len(diff.Modified) != 1 || diff.Modified[0] != "touched" {
+		t.Fatalf("modified %v", diff.Modified)
+	}
+	if len(diff.Changed) != 2 || diff.Changed[0] != "appended" || diff.Changed[1] != "changed" {
+		t.Fatalf("changed %v", diff.Changed)
+	}
+	// "11" is shared by two files, "ee" existed before
+	if diff.NewChunks != 2 || diff.NewBytes != 15 {
+		t.Fatalf("new chunks %d %d", diff.NewChunks, diff.NewBytes)
+	}
+
+	diff = CompareSnapshots(b, b)
+	if len(diff.Added)+len(diff.Deleted)+len(diff.Modified)+len(diff.Changed)+diff.NewChunks != 0 {
+		t.Fatal("snapshot differs from itself")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package snapshot
+
+import (
+	"os"
+	"syscall"
+)
+
+func owner(info os.FileInfo) (int, int) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), int(stat.Gid)
+	}
+	return 0, 0
+}
@@ -0,0 +1,10 @@
+package snapshot
+
+import (
+	"os"
+)
+
+// no numeric owners
+func owner(info os.FileInfo) (int, int) {
+	return 0, 0
+}
@@ -0,0 +1,248 @@
+package snapshot
+
+import (
+	"../hashbin"
+	"bytes"
+	"crypto/sha512"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// manifests are stored in the backend as content chunks plus an index object,
+// and the ref named by the snapshot set path points to the index.
+// pushed paths are listed under PATHS_REF, so every manifest can be found.
+
+// not an absolute path, so no snapshot set uses it
+const PATHS_REF = ":paths"
+
+// concurrent registrations may overwrite each other, so the list is read again
+// after a while, and the path saved again if lost, with growing random delays
+const REGISTER_ATTEMPTS = 5
+
+var registerDelay = time.Second
+
+func (self *SnapshotSet) Push(bin *hashbin.Bin) error {
+	// listed before the ref is saved, a listed path without a ref is skipped
+	err := registerPath(bin, self.Path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("register path: %v", err))
+	}
+	buf := new(bytes.Buffer)
+	err = encodeSnapshots(buf, self.Snapshots, self.Forgotten)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	index := make([]*Chunk, 0)
+	for offset := 0; offset < len(data); offset += MAX_CHUNK_SIZE {
+		end := offset + MAX_CHUNK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk, err := saveBytes(bin, data[offset:end])
+		if err != nil {
+			return err
+		}
+		chunk.Offset = int64(offset)
+		index = append(index, chunk)
+	}
+
+	buf = new(bytes.Buffer)
+	err = gob.NewEncoder(buf).Encode(index)
+	if err != nil {
+		return err
+	}
+	indexChunk, err := saveBytes(bin, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	// the ref must not point to unsaved objects
+	err = bin.Flush()
+	if err != nil {
+		return err
+	}
+	return bin.SaveRef(self.Path, int(indexChunk.Length), indexChunk.Hash)
+}
+
+func saveBytes(bin *hashbin.Bin, data []byte) (*Chunk, error) {
+	hash := sha512.Sum512(data)
+	chunk := &Chunk{
+		Length: int64(len(data)),
+		Hash:   hex.EncodeToString(hash[:]),
+	}
+	exists, err := bin.Exists(len(data), chunk.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = bin.Save(len(data), chunk.Hash, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunk, nil
+}
+
+// keys of the objects holding the current manifest, including the index
+func (self *SnapshotSet) ManifestChunks(bin *hashbin.Bin) ([]*Chunk, error) {
+	length, hash, err := bin.LoadRef(self.Path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("load manifest ref: %v", err))
+	}
+	buf := new(bytes.Buffer)
+	err = bin.Fetch(length, hash, buf)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("fetch manifest index: %v", err))
+	}
+	var index []*Chunk
+	err = gob.NewDecoder(buf).Decode(&index)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decode manifest index: %v", err))
+	}
+	return append(index, &Chunk{
+		Length: int64(length),
+		Hash:   hash,
+	}), nil
+}
+
+// the snapshots and the times of forgotten ones, see Merge
+func (self *SnapshotSet) Pull(bin *hashbin.Bin) ([]*Snapshot, []time.Time, error) {
+	chunks, err := self.ManifestChunks(bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := new(bytes.Buffer)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		err = bin.Fetch(int(chunk.Length), chunk.Hash, buf)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("fetch manifest: %v", err))
+		}
+	}
+	snapshots, forgotten, err := decodeSnapshots(buf)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("decode manifest: %v", err))
+	}
+	return snapshots, forgotten, nil
+}
+
+// paths of the pushed snapshot sets, and the object listing them, nil without one
+func RemotePaths(bin *hashbin.Bin) ([]string, *Chunk, error) {
+	exists, err := bin.RefExists(PATHS_REF)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, nil
+	}
+	length, hash, err := bin.LoadRef(PATHS_REF)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("load paths ref: %v", err))
+	}
+	buf := new(bytes.Buffer)
+	err = bin.Fetch(length, hash, buf)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("fetch paths: %v", err))
+	}
+	var paths []string
+	err = gob.NewDecoder(buf).Decode(&paths)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("decode paths: %v", err))
+	}
+	return paths, &Chunk{
+		Length: int64(length),
+		Hash:   hash,
+	}, nil
+}
+
+func registerPath(bin *hashbin.Bin, path string) error {
+	for i := 0; ; i++ {
+		paths, _, err := RemotePaths(bin)
+		if err != nil {
+			return err
+		}
+		listed := false
+		for _, p := range paths {
+			if p == path {
+				listed = true
+			}
+		}
+		if listed {
+			return nil
+		}
+		if i == REGISTER_ATTEMPTS {
+			return errors.New(fmt.Sprintf("path not registered after %d attempts", REGISTER_ATTEMPTS))
+		}
+		err = savePaths(bin, append(paths, path))
+		if err != nil {
+			return err
+		}
+		time.Sleep(registerDelay + time.Duration(rand.Int63n(int64(registerDelay<<uint(i))+1)))
+	}
+}
+
+func savePaths(bin *hashbin.Bin, paths []string) error {
+	sort.Strings(paths)
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(paths)
+	if err != nil {
+		return err
+	}
+	chunk, err := saveBytes(bin, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = bin.Flush()
+	if err != nil {
+		return err
+	}
+	return bin.SaveRef(PATHS_REF, int(chunk.Length), chunk.Hash)
+}
+
+// add snapshots not already in the set and not forgotten, ordered by time.
+// forgotten times are recorded, so a snapshot forgotten elsewhere is not added later
+func (self *SnapshotSet) Merge(snapshots []*Snapshot, forgotten []time.Time) int {
+	for _, t := range forgotten {
+		if !self.forgotten(t) {
+			self.Forgotten = append(self.Forgotten, t)
+		}
+	}
+	added := 0
+	for _, snapshot := range snapshots {
+		if self.forgotten(snapshot.Time) {
+			continue
+		}
+		exists := false
+		for _, s := range self.Snapshots {
+			if s.Time.Equal(snapshot.Time) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			self.Snapshots = append(self.Snapshots, snapshot)
+			added++
+		}
+	}
+	sort.Stable(byTime(self.Snapshots))
+	return added
+}
+
+func (self *SnapshotSet) forgotten(t time.Time) bool {
+	for _, forgotten := range self.Forgotten {
+		if forgotten.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type byTime []*Snapshot
+
+func (self byTime) Len() int           { return len(self) }
+func (self byTime) Less(i, j int) bool { return self[i].Time.Before(self[j].Time) }
+func (self byTime) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,139 @@
+package snapshot
+
+import (
+	"../hashbin"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushPull(t *testing.T) {
+	bin := hashbin.New(hashbin.NewMembin())
+	set := &SnapshotSet{
+		Path: "/foo",
+	}
+	for i := 0; i < 3; i++ {
+		set.Snapshots = append(set.Snapshots, &Snapshot{
+			Time: time.Unix(int64(i), 0),
+			Files: map[string]*File{
+				"/foo/bar": &File{
+					Path: "/foo/bar",
+					Size: int64(i),
+				},
+			},
+		})
+	}
+	err := set.Push(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := &SnapshotSet{
+		Path: "/foo",
+	}
+	snapshots, forgotten, err := other.Pull(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 || len(forgotten) != 0 || snapshots[2].Files["/foo/bar"].Size != 2 {
+		t.Fatal("pulled snapshots incorrect")
+	}
+	other.Snapshots = snapshots[2:]
+	added := other.Merge(snapshots, forgotten)
+	if added != 2 || len(other.Snapshots) != 3 || !other.Snapshots[0].Time.Equal(time.Unix(0, 0)) {
+		t.Fatal("merge incorrect")
+	}
+
+	// forgotten snapshots are not merged again, in this set or a set pulling its manifest
+	other.Remove(map[int]bool{0: true})
+	if other.Merge(snapshots, forgotten) != 0 || len(other.Snapshots) != 2 {
+		t.Fatal("forgotten snapshot merged")
+	}
+	err = other.Push(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, forgotten, err = set.Pull(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || len(forgotten) != 1 {
+		t.Fatal("forgotten snapshot pulled")
+	}
+	third := &SnapshotSet{
+		Path: "/foo",
+	}
+	third.Snapshots = append(third.Snapshots, set.Snapshots[1:]...)
+	if third.Merge(snapshots, forgotten) != 0 || len(third.Forgotten) != 1 {
+		t.Fatal("tombstone not merged")
+	}
+	third.Merge(set.Snapshots, nil)
+	if len(third.Snapshots) != 2 {
+		t.Fatal("forgotten snapshot merged")
+	}
+
+	other.Path = "/bar"
+	_, _, err = other.Pull(bin)
+	if err == nil {
+		t.Fatal("pulled non exists manifest")
+	}
+
+	// pushed paths are listed
+	err = other.Push(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = set.Push(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, chunk, err := RemotePaths(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != "/bar" || paths[1] != "/foo" || chunk == nil {
+		t.Fatalf("bad paths %v", paths)
+	}
+}
+
+// reads take a while, so concurrent registrations read the same list
+type slowReads struct {
+	*hashbin.Membin
+}
+
+func (self slowReads) NewReader(length int, hash string) (io.Reader, hashbin.Callback, error) {
+	time.Sleep(time.Millisecond * 5)
+	return self.Membin.NewReader(length, hash)
+}
+
+func TestConcurrentRegister(t *testing.T) {
+	registerDelay = time.Millisecond * 20
+	defer func() {
+		registerDelay = time.Second
+	}()
+	bin := hashbin.New(slowReads{hashbin.NewMembin()})
+	wg := new(sync.WaitGroup)
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = registerPath(bin, fmt.Sprintf("/path/%d", i))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, _, err := RemotePaths(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(errs) {
+		t.Fatalf("%d of %d paths registered", len(paths), len(errs))
+	}
+}
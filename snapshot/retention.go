@@ -0,0 +1,143 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Policy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+func (self *Policy) Empty() bool {
+	return self.Last == 0 && self.Hourly == 0 && self.Daily == 0 &&
+		self.Weekly == 0 && self.Monthly == 0 && self.Yearly == 0
+}
+
+// indexes of snapshots to keep. for each rule, the newest snapshot of each
+// of the latest N periods is kept
+func (self *SnapshotSet) Retain(policy *Policy) map[int]bool {
+	rules := []struct {
+		n      int
+		period func(t time.Time) string
+	}{
+		{policy.Last, func(t time.Time) string { return t.String() }},
+		{policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	keep := make(map[int]bool)
+	for _, rule := range rules {
+		n := rule.n
+		last := ""
+		for i := len(self.Snapshots) - 1; i >= 0 && n > 0; i-- {
+			period := rule.period(self.Snapshots[i].Time.Local())
+			if period == last {
+				continue
+			}
+			last = period
+			keep[i] = true
+			n--
+		}
+	}
+	return keep
+}
+
+// remove snapshots by index, leaving tombstones
+func (self *SnapshotSet) Remove(indexes map[int]bool) []*Snapshot {
+	removed := make([]*Snapshot, 0)
+	snapshots := make([]*Snapshot, 0, len(self.Snapshots))
+	for i, snapshot := range self.Snapshots {
+		if indexes[i] {
+			removed = append(removed, snapshot)
+			self.Forgotten = append(self.Forgotten, snapshot.Time)
+		} else {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	self.Snapshots = snapshots
+	return removed
+}
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// a selector is an index, a negative index counting from the last snapshot,
+// or a time selecting the latest snapshot not after it
+func (self *SnapshotSet) Select(selector string) (int, error) {
+	if len(self.Snapshots) == 0 {
+		return 0, errors.New("no snapshot")
+	}
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index < 0 {
+			index += len(self.Snapshots)
+		}
+		if index < 0 || index >= len(self.Snapshots) {
+			return 0, errors.New(fmt.Sprintf("snapshot index out of range: %s", selector))
+		}
+		return index, nil
+	}
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, selector, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" { // whole day
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		i := sort.Search(len(self.Snapshots), func(i int) bool {
+			return self.Snapshots[i].Time.After(t)
+		})
+		if i == 0 {
+			return 0, errors.New(fmt.Sprintf("no snapshot before %s", selector))
+		}
+		return i - 1, nil
+	}
+	for i := len(self.Snapshots) - 1; i >= 0; i-- {
+		if self.Snapshots[i].Tag == selector {
+			return i, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("invalid snapshot selector %s", selector))
+}
+
+// like Select, but a time must name a snapshot at its precision instead of
+// resolving to the nearest earlier one
+func (self *SnapshotSet) SelectExact(selector string) (int, error) {
+	i, err := self.Select(selector)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := strconv.Atoi(selector); err == nil {
+		return i, nil
+	}
+	snapshot := self.Snapshots[i]
+	if snapshot.Tag == selector {
+		return i, nil
+	}
+	for _, layout := range timeLayouts {
+		if layout != "2006-01-02" && snapshot.Time.Format(layout) == selector {
+			return i, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("no snapshot at %s, the nearest earlier one is at %s",
+		selector, snapshot.Time.Format(time.RFC3339)))
+}
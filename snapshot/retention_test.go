@@ -0,0 +1,148 @@
+package snapshot
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetain(t *testing.T) {
+	set := new(SnapshotSet)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.Local)
+	// every 6 hours for 60 days
+	for i := 0; i < 4*60; i++ {
+		set.Snapshots = append(set.Snapshots, &Snapshot{
+			Time: start.Add(time.Hour * 6 * time.Duration(i)),
+		})
+	}
+	n := len(set.Snapshots)
+
+	keep := set.Retain(&Policy{Last: 3})
+	if len(keep) != 3 || !keep[n-1] || !keep[n-3] {
+		t.Fatalf("keep last %v", keep)
+	}
+	keep = set.Retain(&Policy{Daily: 7})
+	if len(keep) != 7 || !keep[n-1] || !keep[n-5] || keep[n-2] {
+		t.Fatalf("keep daily %v", keep)
+	}
+	keep = set.Retain(&Policy{Last: 2, Daily: 2, Monthly: 12})
+	// last two are in the last day; newest of the previous day; newest of january
+	if len(keep) != 4 || !keep[n-1] || !keep[n-2] || !keep[n-5] || !keep[4*31-1] {
+		t.Fatalf("keep combined %v", keep)
+	}
+
+	removed := set.Remove(keep)
+	if len(removed) != 4 || len(set.Snapshots) != n-4 {
+		t.Fatal("remove incorrect")
+	}
+
+	// tombstones are saved
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = set.Save(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := new(SnapshotSet)
+	err = loaded.Load(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Snapshots) != n-4 || len(loaded.Forgotten) != 4 {
+		t.Fatal("tombstones not saved")
+	}
+
+	// older versions decode the snapshots only
+	f, err := os.Open(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshots []*Snapshot
+	err = gob.NewDecoder(z).Decode(&snapshots)
+	if err != nil || len(snapshots) != n-4 {
+		t.Fatalf("snapshots incorrect for older versions: %v", err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	set := new(SnapshotSet)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 10; i++ {
+		set.Snapshots = append(set.Snapshots, &Snapshot{
+			Time: start.Add(time.Hour * 12 * time.Duration(i)),
+		})
+	}
+	set.Snapshots[5].Tag = "weekly"
+	set.Snapshots[8].Tag = "weekly"
+	cases := map[string]int{
+		"0":                   0,
+		"3":                   3,
+		"-1":                  9,
+		"-10":                 0,
+		"2014-01-02":          3,
+		"2014-01-02 11:00":    2,
+		"2014-01-02 12:00:00": 3,
+		"weekly":              8,
+	}
+	for selector, expected := range cases {
+		i, err := set.Select(selector)
+		if err != nil {
+			t.Fatalf("%s: %v", selector, err)
+		}
+		if i != expected {
+			t.Fatalf("%s: selected %d, expected %d", selector, i, expected)
+		}
+	}
+	for _, selector := range []string{"10", "-11", "2013-12-31", "foo"} {
+		_, err := set.Select(selector)
+		if err == nil {
+			t.Fatalf("%s: no error", selector)
+		}
+	}
+}
+
+func TestSelectExact(t *testing.T) {
+	set := new(SnapshotSet)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 10; i++ {
+		set.Snapshots = append(set.Snapshots, &Snapshot{
+			Time: start.Add(time.Hour * 12 * time.Duration(i)),
+		})
+	}
+	set.Snapshots[5].Tag = "weekly"
+	cases := map[string]int{
+		"3":                   3,
+		"-1":                  9,
+		"2014-01-02 12:00":    3,
+		"2014-01-02 12:00:00": 3,
+		start.Add(time.Hour * 12).Format(time.RFC3339): 1,
+		"weekly": 5,
+	}
+	for selector, expected := range cases {
+		i, err := set.SelectExact(selector)
+		if err != nil {
+			t.Fatalf("%s: %v", selector, err)
+		}
+		if i != expected {
+			t.Fatalf("%s: selected %d, expected %d", selector, i, expected)
+		}
+	}
+	for _, selector := range []string{"10", "2014-01-02", "2014-01-02 11:00", "2014-01-02 12:00:01"} {
+		_, err := set.SelectExact(selector)
+		if err == nil {
+			t.Fatalf("%s: no error", selector)
+		}
+	}
+}
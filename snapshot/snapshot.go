@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"compress/gzip"
+	"context"
 	"crypto/sha512"
 	"encoding/gob"
 	"encoding/hex"
@@ -14,6 +15,7 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,19 +23,77 @@ const MAX_CHUNK_SIZE = 16 * 1024 * 1024
 
 type SnapshotSet struct {
 	Snapshots []*Snapshot
+	Forgotten []time.Time // of removed snapshots, not merged again
 	Path      string
+	Chunking  *Chunking
+	Workers   int
 }
 
 type Snapshot struct {
 	Time  time.Time
+	Tag   string
 	Files map[string]*File
 }
 
 type File struct {
 	Path    string
-	Size    int64
+	Size    int64 // of regular files only
 	ModTime time.Time
 	Chunks  []*Chunk
+	Type    int
+	Mode    os.FileMode // permission, setuid, setgid and sticky bits
+	Uid     int
+	Gid     int
+	Target  string // of symlinks
+}
+
+// node types, files recorded by older versions have none and are regular
+const (
+	TYPE_NONE = iota
+	TYPE_REGULAR
+	TYPE_DIR
+	TYPE_SYMLINK
+)
+
+const MODE_BITS = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// info is from lstat
+func newFile(path string, info os.FileInfo) (*File, error) {
+	file := &File{
+		Path:    path,
+		ModTime: info.ModTime(),
+		Mode:    info.Mode() & MODE_BITS,
+	}
+	file.Uid, file.Gid = owner(info)
+	switch {
+	case info.Mode().IsRegular():
+		file.Type = TYPE_REGULAR
+		file.Size = info.Size()
+	case info.IsDir():
+		file.Type = TYPE_DIR
+	case info.Mode()&os.ModeSymlink != 0:
+		file.Type = TYPE_SYMLINK
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		file.Target = target
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported file type %v: %s", info.Mode().Type(), path))
+	}
+	return file, nil
+}
+
+func (self *File) IsRegular() bool {
+	return self.Type == TYPE_REGULAR || self.Type == TYPE_NONE
+}
+
+// type, target, mode and owner are the same. files of older versions only have a type
+func sameMetadata(a, b *File) bool {
+	if a.Type == TYPE_NONE || b.Type == TYPE_NONE {
+		return a.IsRegular() && b.IsRegular()
+	}
+	return a.Type == b.Type && a.Target == b.Target && a.Mode == b.Mode && a.Uid == b.Uid && a.Gid == b.Gid
 }
 
 type Chunk struct {
@@ -54,10 +114,10 @@ func init() {
 
 func New(path string) (*SnapshotSet, error) {
 	info, err := os.Stat(path)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) { // may be restored from backend
 		return nil, err
 	}
-	if !info.IsDir() {
+	if err == nil && !info.IsDir() {
 		return nil, errors.New(fmt.Sprintf("not a directory: %s", path))
 	}
 	return &SnapshotSet{
@@ -66,6 +126,11 @@ func New(path string) (*SnapshotSet, error) {
 }
 
 func (self *SnapshotSet) Snapshot(cacheFile string, readCache bool, strategy int) error {
+	return self.SnapshotContext(context.Background(), cacheFile, readCache, strategy)
+}
+
+// when ctx is cancelled, files already checked are saved to the cache file
+func (self *SnapshotSet) SnapshotContext(ctx context.Context, cacheFile string, readCache bool, strategy int) error {
 	var lastSnapshotFiles map[string]*File
 	if len(self.Snapshots) > 0 {
 		lastSnapshotFiles = self.Snapshots[len(self.Snapshots)-1].Files
@@ -86,19 +151,152 @@ func (self *SnapshotSet) Snapshot(cacheFile string, readCache bool, strategy int
 		}
 	}
 
+	infos, paths, err := self.collect()
+	if err != nil {
+		return err
+	}
+	files := make([]*File, 0, len(infos))
+	for i, info := range infos {
+		path := paths[i]
+		if _, ok := snapshot.Files[path]; readCache && ok {
+			fmt.Printf("skip %s\n", path)
+			continue
+		}
+		file, err := newFile(path, info)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	// each worker holds one chunk buffer
+	workers := self.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	chunking := self.Chunking
+	if chunking == nil {
+		chunking = fixedChunking
+	}
+	type result struct {
+		file *File
+		err  error
+	}
+	jobs := make(chan *File)
+	results := make(chan result)
+	quit := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		for _, file := range files {
+			select {
+			case jobs <- file:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chunking.MaxSize)
+			for file := range jobs {
+				fmt.Printf("checking %s\n", file.Path)
+				err := file.getChunks(ctx, lastSnapshotFiles, strategy, chunking, buf)
+				results <- result{file, err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	cacheTimer := time.NewTimer(time.Second * 10)
+	cancelled := ctx.Done()
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			close(quit)
+		}
+	}
+loop:
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				break loop
+			}
+			if r.err != nil {
+				fail(r.err)
+				continue
+			}
+			snapshot.Files[r.file.Path] = r.file
+		case <-cacheTimer.C: // write to cache
+			if firstErr != nil {
+				continue
+			}
+			t := time.Now()
+			err = saveCache(cacheFile, snapshot.Files)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			cacheTimer.Reset(time.Now().Sub(t) * 10)
+		case <-cancelled:
+			cancelled = nil
+			fail(ctx.Err())
+		}
+	}
+	if firstErr != nil {
+		if firstErr == ctx.Err() {
+			err = saveCache(cacheFile, snapshot.Files)
+			if err != nil {
+				return err
+			}
+		}
+		return firstErr
+	}
+
+	self.Snapshots = append(self.Snapshots, snapshot)
+	return nil
+}
+
+func saveCache(cacheFile string, files map[string]*File) error {
+	fmt.Printf("saving cache\n")
+	f, err := os.Create(cacheFile + ".new")
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot create cache file: %v", err))
+	}
+	err = gob.NewEncoder(f).Encode(files)
+	if err != nil {
+		f.Close()
+		return errors.New(fmt.Sprintf("cannot write to cache file: %v", err))
+	}
+	f.Close()
+	err = os.Rename(cacheFile+".new", cacheFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot write to cache file: %v", err))
+	}
+	fmt.Printf("cache saved\n")
+	return nil
+}
+
+func (self *SnapshotSet) collect() ([]os.FileInfo, []string, error) {
 	infos := make([]os.FileInfo, 0)
 	paths := make([]string, 0)
 	err := collectFiles(self.Path, &infos, &paths)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	cacheTimer := time.NewTimer(time.Second * 10)
 
 	ignorePatterns := make([]*regexp.Regexp, 0)
 	ignoreFilePath := filepath.Join(self.Path, ".fsignore")
 	content, err := ioutil.ReadFile(ignoreFilePath)
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return nil, nil, err
 	}
 	for _, pattern := range strings.Split(string(content), "\n") {
 		pattern = strings.TrimSpace(pattern)
@@ -110,30 +308,9 @@ func (self *SnapshotSet) Snapshot(cacheFile string, readCache bool, strategy int
 		ignorePatterns = append(ignorePatterns, regexp.MustCompilePOSIX(pattern))
 	}
 
-	for i, info := range infos {
-		select {
-		case <-cacheTimer.C: // write to cache
-			fmt.Printf("saving cache\n")
-			t := time.Now()
-			f, err := os.Create(cacheFile + ".new")
-			if err != nil {
-				return errors.New(fmt.Sprintf("cannot create cache file: %v", err))
-			}
-			err = gob.NewEncoder(f).Encode(snapshot.Files)
-			if err != nil {
-				return errors.New(fmt.Sprintf("cannot write to cache file: %v", err))
-			}
-			f.Close()
-			err = os.Rename(cacheFile+".new", cacheFile)
-			if err != nil {
-				return errors.New(fmt.Sprintf("cannot write to cache file: %v", err))
-			}
-			fmt.Printf("cache saved\n")
-			cacheTimer.Reset(time.Now().Sub(t) * 10)
-		default:
-		}
-
-		path := paths[i]
+	retInfos := make([]os.FileInfo, 0, len(infos))
+	retPaths := make([]string, 0, len(paths))
+	for i, path := range paths {
 		relativePath := strings.TrimPrefix(path, self.Path)
 		relativePath = strings.TrimPrefix(relativePath, "/")
 		ignore := false
@@ -147,28 +324,10 @@ func (self *SnapshotSet) Snapshot(cacheFile string, readCache bool, strategy int
 		if ignore {
 			continue
 		}
-
-		if _, ok := snapshot.Files[path]; readCache && ok {
-			fmt.Printf("skip %s\n", path)
-			continue
-		}
-		fmt.Printf("checking %s\n", path)
-
-		file := &File{
-			Path:    path,
-			Size:    info.Size(),
-			ModTime: info.ModTime(),
-		}
-		err = file.getChunks(lastSnapshotFiles, strategy)
-		if err != nil {
-			return err
-		}
-
-		snapshot.Files[file.Path] = file
+		retInfos = append(retInfos, infos[i])
+		retPaths = append(retPaths, path)
 	}
-
-	self.Snapshots = append(self.Snapshots, snapshot)
-	return nil
+	return retInfos, retPaths, nil
 }
 
 func makeSemaphore(n int) chan int {
@@ -179,27 +338,34 @@ func makeSemaphore(n int) chan int {
 	return ret
 }
 
+// regular files, directories and symlinks below top. symlinks are not followed
 func collectFiles(top string, infos *[]os.FileInfo, paths *[]string) error {
 	f, err := os.Open(top)
 	if err != nil {
-		if err.(*os.PathError).Err.Error() == "permission denied" {
+		if os.IsPermission(err) {
 			return nil
 		}
 		return err
 	}
 	subs, err := f.Readdir(-1)
+	f.Close()
 	if err != nil {
 		return err
 	}
 	for _, info := range subs {
+		path := filepath.Join(top, info.Name())
+		mode := info.Mode()
+		if !mode.IsRegular() && !mode.IsDir() && mode&os.ModeSymlink == 0 {
+			fmt.Printf("skip %s, %v\n", path, mode.Type())
+			continue
+		}
+		*infos = append(*infos, info)
+		*paths = append(*paths, path)
 		if info.IsDir() {
-			err = collectFiles(filepath.Join(top, info.Name()), infos, paths)
+			err = collectFiles(path, infos, paths)
 			if err != nil {
 				return err
 			}
-		} else {
-			*infos = append(*infos, info)
-			*paths = append(*paths, filepath.Join(top, info.Name()))
 		}
 	}
 	return nil
@@ -212,36 +378,77 @@ func (self *SnapshotSet) Load(path string) error {
 	} else if err != nil {
 		return err
 	}
-	z, err := gzip.NewReader(f)
-	if err != nil {
+	defer f.Close()
+	snapshots, forgotten, err := decodeSnapshots(f)
+	if err == io.EOF { // empty file
 		return nil
+	} else if err != nil {
+		return err
 	}
-	defer func() {
-		z.Close()
-		f.Close()
-	}()
-	err = gob.NewDecoder(z).Decode(&self.Snapshots)
-	return err
+	self.Snapshots = snapshots
+	self.Forgotten = forgotten
+	return nil
 }
 
 func (self *SnapshotSet) Save(path string) error {
-	f, err := os.OpenFile(path+".new", os.O_RDWR|os.O_CREATE, 0644)
+	f, err := os.OpenFile(path+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	z := gzip.NewWriter(f)
-	err = gob.NewEncoder(z).Encode(self.Snapshots)
+	err = encodeSnapshots(f, self.Snapshots, self.Forgotten)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
 	if err != nil {
-		z.Close()
 		f.Close()
 		return err
 	}
-	z.Close()
 	f.Close()
 	return os.Rename(path+".new", path)
 }
 
-func (self *File) getChunks(lastSnapshotFiles map[string]*File, strategy int) error {
+// times of forgotten snapshots are encoded after the snapshots,
+// older versions decode the snapshots only
+func encodeSnapshots(w io.Writer, snapshots []*Snapshot, forgotten []time.Time) error {
+	z := gzip.NewWriter(w)
+	encoder := gob.NewEncoder(z)
+	err := encoder.Encode(snapshots)
+	if err == nil {
+		err = encoder.Encode(forgotten)
+	}
+	if err != nil {
+		z.Close()
+		return err
+	}
+	return z.Close()
+}
+
+func decodeSnapshots(r io.Reader) ([]*Snapshot, []time.Time, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer z.Close()
+	decoder := gob.NewDecoder(z)
+	var snapshots []*Snapshot
+	err = decoder.Decode(&snapshots)
+	if err != nil {
+		return nil, nil, err
+	}
+	var forgotten []time.Time
+	err = decoder.Decode(&forgotten)
+	if err == io.EOF { // written by older versions
+		err = nil
+	}
+	return snapshots, forgotten, err
+}
+
+func (self *File) getChunks(ctx context.Context, lastSnapshotFiles map[string]*File, strategy int, chunking *Chunking, buf []byte) error {
+	if !self.IsRegular() {
+		return nil
+	}
 	if old, ok := lastSnapshotFiles[self.Path]; ok {
 		if strategy == FAST_CHECK {
 			if old.Size == self.Size && old.ModTime == self.ModTime {
@@ -250,18 +457,18 @@ func (self *File) getChunks(lastSnapshotFiles map[string]*File, strategy int) er
 			}
 		} else if strategy == FAST_HASH {
 			oldChunk := old.GetChunk(0)
-			err := self.HashChunks(1)
+			err := self.hashChunks(ctx, 1, chunking, buf)
 			newChunk := self.GetChunk(0)
 			if err != nil {
 				return err
 			}
-			if oldChunk != nil && oldChunk.Length == newChunk.Length && oldChunk.Hash == newChunk.Hash {
+			if oldChunk != nil && newChunk != nil && oldChunk.Length == newChunk.Length && oldChunk.Hash == newChunk.Hash {
 				self.Chunks = old.Chunks
 				return nil
 			}
 		}
 	}
-	return self.HashChunks(-1)
+	return self.hashChunks(ctx, -1, chunking, buf)
 }
 
 func (self *File) GetChunk(offset int64) *Chunk {
@@ -273,36 +480,56 @@ func (self *File) GetChunk(offset int64) *Chunk {
 	return nil
 }
 
-func (self *File) HashChunks(maxChunks int) error {
+func (self *File) HashChunks(maxChunks int, chunking *Chunking) error {
+	return self.hashChunks(context.Background(), maxChunks, chunking, nil)
+}
+
+func (self *File) hashChunks(ctx context.Context, maxChunks int, chunking *Chunking, buf []byte) error {
+	if chunking == nil {
+		chunking = fixedChunking
+	}
+	if len(buf) < chunking.MaxSize {
+		buf = make([]byte, chunking.MaxSize)
+	}
+	buf = buf[:chunking.MaxSize]
 	offset := int64(0)
-	buf := make([]byte, MAX_CHUNK_SIZE)
-	var n int
-	var err error
 	f, err := os.Open(self.Path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	self.Chunks = make([]*Chunk, 0, 1)
 	hasher := sha512.New()
 	c := 0
+	n := 0
+	eof := false
 	for {
-		n, err = f.Read(buf)
-		if n > 0 {
-			hasher.Reset()
-			hasher.Write(buf[:n])
-			chunk := &Chunk{
-				Offset: offset,
-				Length: int64(n),
-				Hash:   hex.EncodeToString(hasher.Sum(nil)),
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !eof {
+			m, err := io.ReadFull(f, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
 			}
-			offset += int64(n)
-			self.Chunks = append(self.Chunks, chunk)
 		}
-		if err == io.EOF {
+		if n == 0 {
 			break
-		} else if err != nil {
-			return err
 		}
+		length := chunking.cut(buf[:n])
+		hasher.Reset()
+		hasher.Write(buf[:length])
+		chunk := &Chunk{
+			Offset: offset,
+			Length: int64(length),
+			Hash:   hex.EncodeToString(hasher.Sum(nil)),
+		}
+		offset += int64(length)
+		self.Chunks = append(self.Chunks, chunk)
+		n = copy(buf, buf[length:n])
 		c += 1
 		if c == maxChunks {
 			return nil
@@ -1,12 +1,15 @@
 package snapshot
 
 import (
+	"context"
 	crand "crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -19,19 +22,293 @@ func TestSnapshot(t *testing.T) {
 	//if err != nil {
 	//	t.Fatalf("%v", err)
 	//}
-	path := "./testdata"
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(path)
+	err = writeFiles(path, map[string]string{
+		"foo":     "foo",
+		"bar/baz": "baz",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	set, err := New(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cacheFile := filepath.Join(path, ".cache")
+	err = set.Snapshot(cacheFile, false, FULL_HASH)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = set.Snapshot(cacheFile, false, FAST_CHECK)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestParallelSnapshot(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(path)
+	files := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		files[fmt.Sprintf("%d/%d", i%4, i)] = strings.Repeat(fmt.Sprintf("%d", i), i*1024)
+	}
+	err = writeFiles(path, files)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cacheFile, clean := tempCache(t)
+	defer clean()
+	var snapshots []*Snapshot
+	for _, workers := range []int{1, 8} {
+		set, err := New(path)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		set.Workers = workers
+		os.Remove(cacheFile)
+		err = set.Snapshot(cacheFile, false, FULL_HASH)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		snapshots = append(snapshots, set.Snapshots[0])
+	}
+	// and the 4 directories
+	if len(snapshots[0].Files) != len(files)+4 || len(snapshots[1].Files) != len(files)+4 {
+		t.Fatalf("files missing")
+	}
+	for path, file := range snapshots[0].Files {
+		other, ok := snapshots[1].Files[path]
+		if !ok || other.Size != file.Size || !sameChunks(other.Chunks, file.Chunks) {
+			t.Fatalf("parallel snapshot differs at %s", path)
+		}
+	}
+}
+
+func TestCancelledSnapshot(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(path)
+	err = writeFiles(path, map[string]string{
+		"foo": "foo",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
 	set, err := New(path)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	err = set.Snapshot()
+	cacheFile, clean := tempCache(t)
+	defer clean()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = set.SnapshotContext(ctx, cacheFile, false, FULL_HASH)
+	if err != context.Canceled {
+		t.Fatalf("not cancelled: %v", err)
+	}
+	if len(set.Snapshots) > 0 {
+		t.Fatal("cancelled snapshot recorded")
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Fatalf("cache not saved: %v", err)
+	}
+	err = set.Snapshot(cacheFile, true, FULL_HASH)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(set.Snapshots) != 1 || len(set.Snapshots[0].Files) != 1 {
+		t.Fatal("snapshot not continued")
+	}
+}
+
+func TestNodeTypes(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(path)
+	err = writeFiles(path, map[string]string{
+		"a": "a",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = os.Chmod(filepath.Join(path, "a"), 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = os.Mkdir(filepath.Join(path, "empty"), 0700)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, target := range map[string]string{
+		"link":     "a",
+		"dangling": "nowhere",
+		"dirlink":  "empty",
+	} {
+		err = os.Symlink(target, filepath.Join(path, name))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	set, err := New(path)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	err = set.Snapshot()
+	cacheFile, clean := tempCache(t)
+	defer clean()
+	err = set.Snapshot(cacheFile, false, FULL_HASH)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
+	files := set.Snapshots[0].Files
+	if len(files) != 5 {
+		t.Fatalf("%d files recorded", len(files))
+	}
+	a := files[filepath.Join(path, "a")]
+	if a.Type != TYPE_REGULAR || a.Mode != 0600 || a.Size != 1 || len(a.Chunks) != 1 {
+		t.Fatalf("bad regular file %+v", a)
+	}
+	if a.Uid != os.Getuid() || a.Gid != os.Getgid() {
+		t.Fatalf("bad owner %d %d", a.Uid, a.Gid)
+	}
+	empty := files[filepath.Join(path, "empty")]
+	if empty == nil || empty.Type != TYPE_DIR || empty.Mode != 0700 {
+		t.Fatalf("bad directory %+v", empty)
+	}
+	for name, target := range map[string]string{
+		"link":     "a",
+		"dangling": "nowhere",
+		"dirlink":  "empty",
+	} {
+		link := files[filepath.Join(path, name)]
+		if link == nil || link.Type != TYPE_SYMLINK || link.Target != target || len(link.Chunks) != 0 {
+			t.Fatalf("bad symlink %+v", link)
+		}
+	}
+
+	// a retargeted link is a content change
+	err = os.Remove(filepath.Join(path, "link"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = os.Symlink("empty", filepath.Join(path, "link"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = os.Chmod(filepath.Join(path, "a"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = set.Snapshot(cacheFile, false, FAST_CHECK)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	diff := CompareSnapshots(set.Snapshots[0], set.Snapshots[1])
+	if len(diff.Changed) != 1 || diff.Changed[0] != filepath.Join(path, "link") {
+		t.Fatalf("changed %v", diff.Changed)
+	}
+	if len(diff.Modified) != 1 || diff.Modified[0] != filepath.Join(path, "a") {
+		t.Fatalf("modified %v", diff.Modified)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(path)
+	err = writeFiles(path, map[string]string{
+		"a":         "a",
+		"b":         "b",
+		"c":         "c",
+		"ignored":   "ignored",
+		".fsignore": "ignored",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	set, err := New(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cacheFile, clean := tempCache(t)
+	defer clean()
+	err = set.Snapshot(cacheFile, false, FULL_HASH)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = writeFiles(path, map[string]string{
+		"b": "bb",
+		"d": "d",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = os.Remove(filepath.Join(path, "c"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, strategy := range []int{FAST_CHECK, FULL_HASH} {
+		changes, err := set.Check(strategy)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(changes.Added) != 1 || changes.Added[0] != filepath.Join(path, "d") {
+			t.Fatalf("added %v", changes.Added)
+		}
+		if len(changes.Removed) != 1 || changes.Removed[0] != filepath.Join(path, "c") {
+			t.Fatalf("removed %v", changes.Removed)
+		}
+		if len(changes.Modified) != 1 || changes.Modified[0] != filepath.Join(path, "b") {
+			t.Fatalf("modified %v", changes.Modified)
+		}
+		if len(changes.Unchanged) != 2 {
+			t.Fatalf("unchanged %v", changes.Unchanged)
+		}
+	}
+	if len(set.Snapshots) != 1 {
+		t.Fatalf("check recorded a snapshot")
+	}
+}
+
+// a cache file in its own temp dir, removed by the returned func
+func tempCache(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return filepath.Join(dir, "cache"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFiles(dir string, files map[string]string) error {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func generateRandomFileOrDirs(dir string, depth int) error {
@@ -1,6 +1,45 @@
 package main
 
-import ()
+import (
+	"./snapshot"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
 
 func (self *App) runUpdate() {
+	strategy := snapshot.FULL_HASH
+	for _, flag := range self.flags {
+		if flag == "-fc" || flag == "--fast-check" {
+			strategy = snapshot.FAST_CHECK
+		} else if flag == "-fh" || flag == "--fast-hash" {
+			strategy = snapshot.FAST_HASH
+		} else if flag == "--cdc" || strings.HasPrefix(flag, "--cdc=") {
+			self.setChunking(flag)
+		} else if flag[0] == '-' {
+			fmt.Printf("unknown option %s\n", flag)
+			os.Exit(0)
+		}
+	}
+
+	changes, err := self.snapshotSet.Check(strategy)
+	if err != nil {
+		log.Fatalf("check error: %v", err)
+	}
+
+	for _, path := range changes.Added {
+		fmt.Printf("+ %s\n", path)
+	}
+	for _, path := range changes.Removed {
+		fmt.Printf("- %s\n", path)
+	}
+	for _, path := range changes.Modified {
+		fmt.Printf("M %s\n", path)
+	}
+	for _, path := range changes.Unchanged {
+		fmt.Printf("  %s\n", path)
+	}
+	fmt.Printf("%d added, %d removed, %d modified, %d unchanged\n",
+		len(changes.Added), len(changes.Removed), len(changes.Modified), len(changes.Unchanged))
 }
@@ -1,171 +1,406 @@
 package main
 
 import (
-	"./baidu"
 	"./hashbin"
+	"./journal"
+	"./replica"
 	"./snapshot"
 	"./utils"
-	"bytes"
-	"code.google.com/p/goauth2/oauth"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Job struct {
 	backend *hashbin.Bin
+	journal *journal.Journal
 	path    string
 	chunk   *snapshot.Chunk
 }
 
 func (self *App) runUpload() {
-	matchPatterns := make([]*regexp.Regexp, 0)
-	for _, arg := range self.args {
-		matchPatterns = append(matchPatterns, regexp.MustCompilePOSIX("^"+arg))
+	var selector string
+	all := false
+	recheck := false
+	policy := new(hashbin.RetryPolicy)
+	*policy = *hashbin.DefaultRetryPolicy
+	for _, flag := range self.flags {
+		if strings.HasPrefix(flag, "--snapshot=") {
+			selector = strings.TrimPrefix(flag, "--snapshot=")
+		} else if flag == "--all" {
+			all = true
+		} else if flag == "--recheck" {
+			recheck = true
+		} else if strings.HasPrefix(flag, "--attempts=") {
+			attempts, err := strconv.Atoi(strings.TrimPrefix(flag, "--attempts="))
+			if err != nil || attempts <= 0 {
+				fmt.Printf("invalid option %s\n", flag)
+				os.Exit(0)
+			}
+			policy.Attempts = attempts
+		} else {
+			fmt.Printf("unknown option %s\n", flag)
+			os.Exit(0)
+		}
 	}
+	matchPatterns := compilePatterns(self.args)
 
-	// backends //TODO configurable
 	backends := make([]*hashbin.Bin, 0)
-	b, err := self.getBaiduBackend() // baidu
+	journals := make([]*journal.Journal, 0)
+	name, err := self.backendName()
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := self.openBackend(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backends = append(backends, hashbin.New(b))
+	// completed chunks of interrupted runs
+	if recheck {
+		err = os.Remove(self.journalPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+	// dropped if a gc ran since, possibly on another machine
+	generation, err := backends[0].Generation()
+	if err != nil {
+		log.Fatalf("load gc generation: %v", err)
+	}
+	j, err := journal.Open(self.journalPath(name), generation)
 	if err != nil {
 		log.Fatal(err)
 	}
-	backends = append(backends, b)
+	journals = append(journals, j)
 
-	// snapshot to upload //TODO specifiable
-	if len(self.snapshotSet.Snapshots) == 0 {
+	// snapshots to upload
+	var snapshots []*snapshot.Snapshot
+	if all {
+		snapshots = self.snapshotSet.Snapshots
+	} else {
+		snap, err := self.selectSnapshot(selector)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(0)
+		}
+		snapshots = []*snapshot.Snapshot{snap}
+	}
+	if len(snapshots) == 0 {
 		fmt.Printf("no snapshot\n")
 		os.Exit(0)
 	}
 	lastSnapshot := self.snapshotSet.Snapshots[len(self.snapshotSet.Snapshots)-1]
 
-	// generate jobs
-	paths := make([]string, 0, len(lastSnapshot.Files))
-	for path, _ := range lastSnapshot.Files {
-		paths = append(paths, path)
-	}
-	sort.Strings(paths)
-	jobs := make([]Job, 0)
-	var totalSize int64
+	// collect distinct chunks, newest snapshot first
+	// files of older snapshots are read only if unchanged on disk
 	fmt.Printf("collecting jobs\n")
-	for _, path := range paths {
-		if len(matchPatterns) > 0 {
-			ignore := true
-			relativePath := strings.TrimPrefix(path, self.path)
-			relativePath = strings.TrimPrefix(relativePath, "/")
-			for _, p := range matchPatterns {
-				if p.MatchString(relativePath) {
-					ignore = false
-					break
-				}
-			}
-			if ignore {
-				continue
+	sources := make(map[string]Job)
+	keys := make([]string, 0)
+	unavailable := make(map[string]Job)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snap := snapshots[i]
+		paths := make([]string, 0, len(snap.Files))
+		for path, _ := range snap.Files {
+			if self.matchPath(matchPatterns, path) {
+				paths = append(paths, path)
 			}
 		}
-		file := lastSnapshot.Files[path]
-		for _, chunk := range file.Chunks {
-			for _, backend := range backends {
-				exists, err := backend.Exists(int(chunk.Length), chunk.Hash)
-				if err != nil {
-					log.Fatal(err)
+		sort.Strings(paths)
+		for _, path := range paths {
+			file := snap.Files[path]
+			usable := snap == lastSnapshot || unchangedOnDisk(file)
+			for _, chunk := range file.Chunks {
+				key := fmt.Sprintf("%d-%s", chunk.Length, chunk.Hash)
+				if _, ok := sources[key]; ok {
+					continue
 				}
-				if exists {
+				if !usable {
+					unavailable[key] = Job{
+						chunk: chunk,
+						path:  path,
+					}
 					continue
 				}
-				totalSize += chunk.Length
-				jobs = append(jobs, Job{
-					backend: backend,
-					chunk:   chunk,
-					path:    path,
-				})
+				delete(unavailable, key)
+				sources[key] = Job{
+					chunk: chunk,
+					path:  path,
+				}
+				keys = append(keys, key)
 			}
 		}
 	}
+
+	// generate jobs
+	jobs := make([]Job, 0)
+	var totalSize, uploaded int64
+	journaled := 0
+	// unavailable chunks a backend does not have yet, they fail the upload
+	failures := make([]Failure, 0)
+	missing := 0
+	for i, backend := range backends {
+		unknown := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if journals[i].Has(key) {
+				journaled++
+				totalSize += sources[key].chunk.Length
+				uploaded += sources[key].chunk.Length
+				continue
+			}
+			unknown = append(unknown, key)
+		}
+		for key := range unavailable {
+			if !journals[i].Has(key) {
+				unknown = append(unknown, key)
+			}
+		}
+		fmt.Printf("checking %d chunks\n", len(unknown))
+		present, err := backend.ExistsBatchContext(self.ctx, unknown)
+		if err != nil && self.ctx.Err() != nil {
+			closeJournals(journals)
+			fmt.Printf("interrupted\n")
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range unknown {
+			if present[key] {
+				journals[i].Add(key)
+				continue
+			}
+			if job, ok := unavailable[key]; ok {
+				job.backend = backend
+				failures = append(failures, Failure{job, errors.New("not available locally")})
+				missing++
+				continue
+			}
+			source := sources[key]
+			totalSize += source.chunk.Length
+			jobs = append(jobs, Job{
+				backend: backend,
+				journal: journals[i],
+				chunk:   source.chunk,
+				path:    source.path,
+			})
+		}
+	}
+	if journaled > 0 {
+		fmt.Printf("%d chunks uploaded by previous runs, %s\n", journaled, utils.FormatSize(int(uploaded)))
+	}
+	if missing > 0 {
+		fmt.Printf("%d chunks not available locally nor in the backend\n", missing)
+	}
 	fmt.Printf("%d jobs\n", len(jobs))
 
 	// upload
 	semSize := 4
-	sem := make(chan []byte, semSize)
-	for i := 0; i < semSize; i++ {
-		sem <- make([]byte, snapshot.MAX_CHUNK_SIZE)
+	sem := make(chan bool, semSize)
+
+	// saved chunks are journaled after the backends are flushed
+	saved := make([]Job, 0)
+	savedLock := new(sync.Mutex)
+	checkpointLock := new(sync.Mutex)
+	checkpoint := func() error {
+		checkpointLock.Lock()
+		defer checkpointLock.Unlock()
+		savedLock.Lock()
+		flushing := saved
+		saved = make([]Job, 0)
+		savedLock.Unlock()
+		for _, backend := range backends {
+			err := backend.Flush()
+			if err != nil {
+				savedLock.Lock()
+				saved = append(saved, flushing...)
+				savedLock.Unlock()
+				return err
+			}
+		}
+		for _, job := range flushing {
+			job.journal.Add(fmt.Sprintf("%d-%s", job.chunk.Length, job.chunk.Hash))
+		}
+		for _, j := range journals {
+			err := j.Sync()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	var uploaded int64
+	ticker := time.NewTicker(time.Second * 10)
 	go func() {
-		for _ = range time.NewTicker(time.Second * 10).C {
+		ticks := 0
+		for _ = range ticker.C {
+			done := atomic.LoadInt64(&uploaded)
 			fmt.Printf("=> %s / %s / %s\n",
-				utils.FormatSize(int(uploaded)),
+				utils.FormatSize(int(done)),
 				utils.FormatSize(int(totalSize)),
-				utils.FormatSize(int(totalSize-uploaded)))
+				utils.FormatSize(int(totalSize-done)))
+			ticks++
+			if ticks%6 == 0 {
+				err := checkpoint()
+				if err != nil {
+					fmt.Printf("checkpoint error: %v\n", err)
+				}
+			}
 		}
 	}()
 
+	failuresLock := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
-	wg.Add(len(jobs))
 	for i, job := range jobs {
-		buf := <-sem
+		select {
+		case sem <- true:
+		case <-self.ctx.Done():
+		}
+		if self.ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
 		go func(i int, job Job) {
 			defer func() {
-				sem <- buf
-				uploaded += job.chunk.Length
+				<-sem
 				wg.Done()
 			}()
-			f, err := os.OpenFile(job.path, os.O_RDONLY, 0644)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer f.Close()
-			o, err := f.Seek(job.chunk.Offset, 0)
-			if err != nil || o != job.chunk.Offset {
-				log.Fatal(err)
-			}
-			buf = buf[:job.chunk.Length]
-			n, err := io.ReadFull(f, buf)
-			if int64(n) != job.chunk.Length || err != nil {
-				log.Fatal(err)
-			}
 			t0 := time.Now()
-			err = job.backend.Save(int(job.chunk.Length), job.chunk.Hash, bytes.NewReader(buf))
+			attempts, err := uploadChunk(self.ctx, job, policy)
+			if err != nil && self.ctx.Err() != nil { // uploaded by the next run
+				return
+			}
 			if err != nil {
-				fmt.Printf("%v\n", err)
+				fmt.Printf("=> job %d / %d failed: %s %d\n\t%v\n", i+1, len(jobs), job.path, job.chunk.Offset, err)
+				failuresLock.Lock()
+				failures = append(failures, Failure{job, err})
+				failuresLock.Unlock()
+				return
 			}
-			fmt.Printf("=> job %d / %d: %s %d\n\t%d-%s... %v %s\n",
+			atomic.AddInt64(&uploaded, job.chunk.Length)
+			savedLock.Lock()
+			saved = append(saved, job)
+			savedLock.Unlock()
+			fmt.Printf("=> job %d / %d: %s %d\n\t%d-%s... %v %s, %d attempts\n",
 				i+1, len(jobs),
 				job.path, job.chunk.Offset,
 				job.chunk.Length, job.chunk.Hash[:16], time.Now().Sub(t0),
-				utils.FormatSize(int(job.chunk.Length)))
+				utils.FormatSize(int(job.chunk.Length)), attempts)
 		}(i, job)
 	}
 	wg.Wait()
+	ticker.Stop()
+
+	interrupted := self.ctx.Err() != nil
+
+	// chunks saved before an interrupt are journaled too
+	err = checkpoint()
+	if err != nil {
+		fmt.Printf("flush error: %v\n", err)
+		for _, job := range saved {
+			failures = append(failures, Failure{job, err})
+		}
+	}
+	// manifests must not reference chunks not uploaded
+	pushed := false
+	pushFailed := false
+	if !interrupted && len(failures) == 0 {
+		pushed = true
+		for _, backend := range backends {
+			err = self.pushSnapshots(backend)
+			if err != nil {
+				fmt.Printf("push snapshots error: %v\n", err)
+				pushFailed = true
+			}
+		}
+	}
+	closeJournals(journals)
+	// after the last flush, which repairs replicas
+	if r, ok := b.(*replica.Replica); ok {
+		for i, health := range r.Health() {
+			fmt.Printf("replica %d: %d writes, %d failed, %d to repair", i, health.Writes, health.Failures, health.Missing)
+			if health.LastError != nil {
+				fmt.Printf(", last error: %v", health.LastError)
+			}
+			fmt.Printf("\n")
+		}
+	}
 
-	if len(jobs) > 0 {
-		time.Sleep(time.Second * 20) // for backend save
+	if len(failures) > 0 {
+		var size int64
+		sort.Sort(failuresByPath(failures))
+		for _, failure := range failures {
+			size += failure.job.chunk.Length
+			fmt.Printf("failed: %s %d %d-%s...: %v\n", failure.job.path, failure.job.chunk.Offset,
+				failure.job.chunk.Length, failure.job.chunk.Hash[:16], failure.err)
+		}
+		fmt.Printf("%d of %d chunks failed, %s not uploaded\n", len(failures), len(jobs)+missing, utils.FormatSize(int(size)))
+	}
+	if interrupted {
+		fmt.Printf("interrupted, %s of %s uploaded\n",
+			utils.FormatSize(int(atomic.LoadInt64(&uploaded))), utils.FormatSize(int(totalSize)))
+	}
+	if !pushed {
+		fmt.Printf("snapshots not pushed\n")
+	}
+	if len(failures) > 0 || interrupted || pushFailed {
+		os.Exit(1)
 	}
 }
 
-func (self *App) getBaiduBackend() (*hashbin.Bin, error) {
-	var dir string
-	var token oauth.Token
-	err := self.register.Get("baidu_dir", &dir)
-	if err != nil {
-		return nil, err
+func closeJournals(journals []*journal.Journal) {
+	for _, j := range journals {
+		err := j.Close()
+		if err != nil {
+			fmt.Printf("close journal: %v\n", err)
+		}
 	}
-	err = self.register.Get("baidu_token", &token)
-	if err != nil {
-		return nil, err
+}
+
+type Failure struct {
+	job Job
+	err error
+}
+
+type failuresByPath []Failure
+
+func (self failuresByPath) Len() int      { return len(self) }
+func (self failuresByPath) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self failuresByPath) Less(i, j int) bool {
+	if self[i].job.path != self[j].job.path {
+		return self[i].job.path < self[j].job.path
 	}
-	keyCacheFilePath := filepath.Join(self.dataDir, "baidu.keys")
-	b, err := baidu.New(dir, &token, keyCacheFilePath)
+	return self[i].job.chunk.Offset < self[j].job.chunk.Offset
+}
+
+// returns the number of save attempts
+// the chunk is streamed from the file, a changed file fails the hash check
+func uploadChunk(ctx context.Context, job Job, policy *hashbin.RetryPolicy) (int, error) {
+	f, err := os.Open(job.path)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return hashbin.New(b), nil
+	defer f.Close()
+	reader := io.NewSectionReader(f, job.chunk.Offset, job.chunk.Length)
+	return job.backend.SaveRetryContext(ctx, int(job.chunk.Length), job.chunk.Hash, reader, policy)
+}
+
+func (self *App) journalPath(backendName string) string {
+	return filepath.Join(self.dataDir, backendName+".journal")
+}
+
+// whether the file content is still the one recorded in the snapshot
+func unchangedOnDisk(file *snapshot.File) bool {
+	info, err := os.Stat(file.Path)
+	return err == nil && info.Size() == file.Size && info.ModTime().Equal(file.ModTime)
 }
@@ -1,7 +1,13 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
 )
 
 func FormatSize(n int) string {
@@ -20,3 +26,31 @@ func FormatSize(n int) string {
 	}
 	return ret
 }
+
+func ParseSize(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := "bkmgt"
+	multiplier := 1
+	if s != "" {
+		if i := strings.IndexByte(units, s[len(s)-1]); i >= 0 {
+			multiplier = 1 << uint(10*i)
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid size %s", s))
+	}
+	return n * multiplier, nil
+}
+
+// a multipart form body holding data of the given length as a single file field.
+// the closing boundary is read only after data reaches EOF
+func MultipartBody(field string, data io.Reader, length int) (body io.Reader, contentType string, size int64) {
+	head := new(bytes.Buffer)
+	form := multipart.NewWriter(head)
+	form.CreateFormFile(field, "file")
+	tail := fmt.Sprintf("\r\n--%s--\r\n", form.Boundary())
+	size = int64(head.Len() + length + len(tail))
+	return io.MultiReader(head, data, strings.NewReader(tail)), form.FormDataContentType(), size
+}